@@ -0,0 +1,421 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing schemes accepted by hashPassword.
+const (
+	hashBcrypt   = "bcrypt"
+	hashArgon2id = "argon2id"
+)
+
+// Parameters for new argon2id hashes, as recommended by RFC 9106 for
+// memory-constrained machines. Existing hashes keep their own.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Threads = 2
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+const (
+	// maxHashChecks bounds the password hashes checked at once, as each
+	// takes a lot of CPU time and, for argon2id, memory.
+	maxHashChecks = 4
+	// verifiedLoginTTL is how long a verified login is remembered, so the
+	// page's requests and event stream reconnects skip the hash check.
+	verifiedLoginTTL = 5 * time.Minute
+)
+
+var (
+	hashChecks     = make(chan struct{}, maxHashChecks)
+	verifiedLogins = newLoginCache()
+)
+
+// hashPassword hashes the password with the given scheme, in the usual
+// "$2a$..." form for bcrypt or the PHC "$argon2id$..." form for argon2id.
+func hashPassword(password, scheme string) (string, error) {
+	switch scheme {
+	case hashBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash password: %w", err)
+		}
+		return string(hash), nil
+	case hashArgon2id:
+		h := &argon2Hash{time: argon2Time, memory: argon2Memory, threads: argon2Threads, key: make([]byte, argon2KeyLen)}
+		return h.rehash(password), nil
+	default:
+		return "", fmt.Errorf("unknown hash %q: use %s or %s", scheme, hashBcrypt, hashArgon2id)
+	}
+}
+
+// argon2Hash is a parsed "$argon2id$v=19$m=...,t=...,p=...$salt$key" hash.
+type argon2Hash struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// rehash hashes the password with h's parameters and a new salt.
+func (h *argon2Hash) rehash(password string) string {
+	salt := make([]byte, argon2SaltLen)
+	rand.Read(salt)
+	key := argon2.IDKey([]byte(password), salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.memory, h.time, h.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func parseArgon2Hash(hash string) (*argon2Hash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != hashArgon2id {
+		return nil, errors.New("not an argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2id version %q", parts[2])
+	}
+	h := &argon2Hash{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, fmt.Errorf("invalid argon2id parameters %q", parts[3])
+	}
+	if h.time == 0 || h.threads == 0 {
+		return nil, fmt.Errorf("invalid argon2id parameters %q", parts[3])
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, errors.New("invalid argon2id salt")
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, errors.New("invalid argon2id key")
+	}
+	return h, nil
+}
+
+// checkHash reports whether hash is a bcrypt or argon2id hash that
+// checkPassword can verify.
+func checkHash(hash string) error {
+	if strings.HasPrefix(hash, "$"+hashArgon2id+"$") {
+		_, err := parseArgon2Hash(hash)
+		return err
+	}
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return errors.New("not a bcrypt or argon2id hash")
+	}
+	return nil
+}
+
+// checkPassword reports whether password matches hash. Both schemes compare
+// the keys in constant time.
+func checkPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "$"+hashArgon2id+"$") {
+		h, err := parseArgon2Hash(hash)
+		if err != nil {
+			return false
+		}
+		key := argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+		return subtle.ConstantTimeCompare(key, h.key) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// dummyHashFor hashes a random password the way most of the users' passwords
+// are hashed, scheme and parameters alike. Unknown users are checked against
+// it so they take as long to reject as known ones.
+func dummyHashFor(users map[string]string) (string, error) {
+	counts := make(map[string]int)
+	var like string
+	for _, hash := range users {
+		params := hashParams(hash)
+		counts[params]++
+		if like == "" || counts[params] > counts[hashParams(like)] {
+			like = hash
+		}
+	}
+
+	password := rand.Text()
+	if h, err := parseArgon2Hash(like); err == nil {
+		return h.rehash(password), nil
+	}
+	cost, err := bcrypt.Cost([]byte(like))
+	if err != nil {
+		cost = bcrypt.DefaultCost
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+// hashParams is the part of a hash that says how it was made, without the
+// salt or key: "$2a$10" or "$argon2id$v=19$m=65536,t=3,p=2".
+func hashParams(hash string) string {
+	parts := strings.Split(hash, "$")
+	if len(parts) > 4 && parts[1] == hashArgon2id {
+		return strings.Join(parts[:4], "$")
+	}
+	if len(parts) > 2 {
+		return strings.Join(parts[:3], "$")
+	}
+	return ""
+}
+
+// loginCache remembers recently verified logins. It keeps an HMAC of each
+// password under a key made at startup, never the password itself.
+type loginCache struct {
+	key     []byte
+	mu      sync.Mutex
+	entries map[string]verifiedLogin // By user name
+}
+
+type verifiedLogin struct {
+	hash    string // The user's hash the password was checked against
+	mac     []byte
+	expires time.Time
+}
+
+func newLoginCache() *loginCache {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &loginCache{key: key, entries: make(map[string]verifiedLogin)}
+}
+
+func (c *loginCache) mac(user, password string) []byte {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(user))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+// verified reports whether the password was checked against the user's
+// current hash within verifiedLoginTTL. A user whose hash has since changed
+// is checked again.
+func (c *loginCache) verified(user, hash, password string) bool {
+	c.mu.Lock()
+	login, exists := c.entries[user]
+	c.mu.Unlock()
+	return exists && login.hash == hash && time.Now().Before(login.expires) && hmac.Equal(login.mac, c.mac(user, password))
+}
+
+func (c *loginCache) add(user, hash, password string) {
+	login := verifiedLogin{hash: hash, mac: c.mac(user, password), expires: time.Now().Add(verifiedLoginTTL)}
+	c.mu.Lock()
+	c.entries[user] = login
+	c.mu.Unlock()
+}
+
+// loginThrottle counts failed logins by client address, and locks an address
+// out for a while once it has failed too often.
+type loginThrottle struct {
+	maxFailures int           // Failures that lock an address out, or 0 for no limit
+	lockout     time.Duration // How long a lockout lasts, and how long failures are counted for
+
+	mu       sync.Mutex
+	failures map[string]*loginFailures
+}
+
+// loginFailures are the recent failed logins from one address.
+type loginFailures struct {
+	count       int
+	byUser      map[string]int // Failures counted by the user name tried
+	pending     int            // Logins begun but not yet ended
+	first       time.Time
+	lockedUntil time.Time
+}
+
+func newLoginThrottle(maxFailures int, lockout time.Duration) *loginThrottle {
+	return &loginThrottle{
+		maxFailures: maxFailures,
+		lockout:     lockout,
+		failures:    make(map[string]*loginFailures),
+	}
+}
+
+// lockedOut returns how much longer the address is locked out, or 0.
+func (t *loginThrottle) lockedOut(addr string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if f, exists := t.failures[addr]; exists {
+		return max(time.Until(f.lockedUntil), 0)
+	}
+	return 0
+}
+
+// begin reserves a login attempt for the address. Attempts still being
+// checked count as failures until they end, so concurrent guesses cannot run
+// past the lockout. It returns false if the address has none left.
+func (t *loginThrottle) begin(addr string) bool {
+	if t.maxFailures <= 0 {
+		return true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	// Forget addresses that have been quiet for a whole lockout period
+	for a, f := range t.failures {
+		if f.pending == 0 && now.Sub(f.first) >= t.lockout && now.After(f.lockedUntil) {
+			delete(t.failures, a)
+		}
+	}
+
+	f, exists := t.failures[addr]
+	if !exists {
+		f = &loginFailures{first: now}
+		t.failures[addr] = f
+	}
+	if now.Before(f.lockedUntil) || f.count+f.pending >= t.maxFailures {
+		return false
+	}
+	f.pending++
+	return true
+}
+
+// end records how a login begun with begin went. A failure that brings the
+// address to maxFailures within the lockout period locks it out. A success
+// only clears the failures of the same user, so logging in to one account
+// does not reset the guesses made at another.
+func (t *loginThrottle) end(addr, user string, ok bool) {
+	if t.maxFailures <= 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f := t.failures[addr]
+	f.pending--
+	if ok {
+		f.count -= f.byUser[user]
+		delete(f.byUser, user)
+		if f.count == 0 && f.pending == 0 && time.Now().After(f.lockedUntil) {
+			delete(t.failures, addr)
+		}
+		return
+	}
+
+	if f.byUser == nil {
+		f.byUser = make(map[string]int)
+	}
+	f.count++
+	f.byUser[user]++
+	if f.count >= t.maxFailures {
+		log.Printf("Locking out %s for %s after %d failed logins, the last as %q", addr, t.lockout, f.count, user)
+		f.lockedUntil = time.Now().Add(t.lockout)
+		f.count = 0
+		f.byUser = nil
+		f.first = time.Now()
+	}
+}
+
+// release gives back a login begun with begin that was never checked, such
+// as one whose client went away while it waited, without counting it.
+func (t *loginThrottle) release(addr string) {
+	if t.maxFailures <= 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failures[addr].pending--
+}
+
+// clientAddr is the address logins are throttled by: the client's IP
+// without its port.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// basicAuth lets a request through to handler only with the credentials of
+// one of the users. Addresses that fail to log in too often are locked out by
+// loginLimiter.
+func basicAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addr := clientAddr(r)
+		if wait := loginLimiter.lockedOut(addr); wait > 0 {
+			tooManyLogins(w, wait)
+			return
+		}
+
+		user, pass, ok := r.BasicAuth()
+		if !ok {
+			// A browser asks without credentials first, which is not a failure
+			unauthorized(w)
+			return
+		}
+
+		usersMu.Lock()
+		hash, exists := users[user]
+		if !exists {
+			hash = unknownUserHash
+		}
+		usersMu.Unlock()
+		if exists && verifiedLogins.verified(user, hash, pass) {
+			handler(w, r)
+			return
+		}
+
+		if !loginLimiter.begin(addr) {
+			tooManyLogins(w, loginLimiter.lockedOut(addr))
+			return
+		}
+		select {
+		case hashChecks <- struct{}{}:
+		case <-r.Context().Done():
+			loginLimiter.release(addr)
+			return
+		}
+		// The hash is always checked so unknown users take as long to reject
+		valid := checkPassword(hash, pass) && exists && pass != ""
+		<-hashChecks
+		loginLimiter.end(addr, user, valid)
+		if !valid {
+			unauthorized(w)
+			return
+		}
+
+		verifiedLogins.add(user, hash, pass)
+		handler(w, r)
+	}
+}
+
+// tooManyLogins turns away a locked out address, or one with too many logins
+// already being checked, which may try again in a second.
+func tooManyLogins(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(wait.Seconds())), 1)))
+	http.Error(w, "Too many failed logins, try again later", http.StatusTooManyRequests)
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="Please enter your username and password."`)
+	w.WriteHeader(http.StatusUnauthorized)
+	fmt.Fprintln(w, "Unauthorized")
+}
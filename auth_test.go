@@ -0,0 +1,204 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+const testAddr = "192.0.2.1"
+
+// loginStep is one login from testAddr in TestLoginThrottle.
+type loginStep struct {
+	action string // "fail", "succeed", "hold" to begin without ending, or "release"
+	user   string
+	begins bool // What begin should return; ignored for "release"
+}
+
+func TestLoginThrottle(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxFailures int
+		steps       []loginStep
+		lockedOut   bool
+	}{
+		{
+			name:        "failures lock out",
+			maxFailures: 3,
+			steps: []loginStep{
+				{"fail", "alice", true},
+				{"fail", "alice", true},
+				{"fail", "alice", true},
+				{"succeed", "alice", false},
+			},
+			lockedOut: true,
+		},
+		{
+			name:        "success clears the user's failures",
+			maxFailures: 3,
+			steps: []loginStep{
+				{"fail", "alice", true},
+				{"fail", "alice", true},
+				{"succeed", "alice", true},
+				{"fail", "alice", true},
+				{"fail", "alice", true},
+			},
+		},
+		{
+			name:        "success keeps other users' failures",
+			maxFailures: 3,
+			steps: []loginStep{
+				{"fail", "alice", true},
+				{"fail", "bob", true},
+				{"succeed", "bob", true},
+				{"fail", "carol", true},
+				{"fail", "dave", true},
+				{"fail", "alice", false},
+			},
+			lockedOut: true,
+		},
+		{
+			name:        "pending logins count",
+			maxFailures: 3,
+			steps: []loginStep{
+				{"hold", "alice", true},
+				{"hold", "alice", true},
+				{"hold", "alice", true},
+				{"fail", "alice", false},
+			},
+		},
+		{
+			name:        "released logins do not count",
+			maxFailures: 3,
+			steps: []loginStep{
+				{"hold", "alice", true},
+				{"hold", "alice", true},
+				{"fail", "alice", true},
+				{"release", "", false},
+				{"release", "", false},
+				{"fail", "alice", true},
+			},
+		},
+		{
+			name:        "no limit",
+			maxFailures: 0,
+			steps: []loginStep{
+				{"fail", "alice", true},
+				{"fail", "alice", true},
+				{"fail", "alice", true},
+				{"fail", "alice", true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			throttle := newLoginThrottle(tt.maxFailures, time.Hour)
+			for i, step := range tt.steps {
+				if step.action == "release" {
+					throttle.release(testAddr)
+					continue
+				}
+				if got := throttle.begin(testAddr); got != step.begins {
+					t.Fatalf("step %d: begin returned %v, want %v", i, got, step.begins)
+				}
+				if !step.begins {
+					continue
+				}
+				switch step.action {
+				case "fail":
+					throttle.end(testAddr, step.user, false)
+				case "succeed":
+					throttle.end(testAddr, step.user, true)
+				}
+			}
+
+			if got := throttle.lockedOut(testAddr) > 0; got != tt.lockedOut {
+				t.Errorf("locked out: %v, want %v", got, tt.lockedOut)
+			}
+		})
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	bcryptHash, err := hashPassword("secret", hashBcrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon2Hash, err := hashPassword("secret", hashArgon2id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		want     bool
+	}{
+		{"bcrypt match", bcryptHash, "secret", true},
+		{"bcrypt mismatch", bcryptHash, "Secret", false},
+		{"bcrypt empty password", bcryptHash, "", false},
+		{"argon2id match", argon2Hash, "secret", true},
+		{"argon2id mismatch", argon2Hash, "Secret", false},
+		{"argon2id empty password", argon2Hash, "", false},
+		{"plain text", "secret", "secret", false},
+		{"empty hash", "", "", false},
+		{"broken argon2id", "$argon2id$v=19$m=65536,t=3,p=2$", "secret", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkPassword(tt.hash, tt.password); got != tt.want {
+				t.Errorf("checkPassword(%q, %q) = %v, want %v", tt.hash, tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseArgon2Hash(t *testing.T) {
+	const salt = "c2FsdHNhbHRzYWx0c2FsdA"
+	const key = "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+
+	tests := []struct {
+		name    string
+		hash    string
+		wantErr bool
+		want    argon2Hash
+	}{
+		{
+			name: "valid",
+			hash: "$argon2id$v=19$m=65536,t=3,p=2$" + salt + "$" + key,
+			want: argon2Hash{time: 3, memory: 65536, threads: 2},
+		},
+		{name: "argon2i", hash: "$argon2i$v=19$m=65536,t=3,p=2$" + salt + "$" + key, wantErr: true},
+		{name: "bcrypt", hash: "$2a$10$abcdefghijklmnopqrstuu", wantErr: true},
+		{name: "old version", hash: "$argon2id$v=16$m=65536,t=3,p=2$" + salt + "$" + key, wantErr: true},
+		{name: "missing parameters", hash: "$argon2id$v=19$m=65536$" + salt + "$" + key, wantErr: true},
+		{name: "zero time", hash: "$argon2id$v=19$m=65536,t=0,p=2$" + salt + "$" + key, wantErr: true},
+		{name: "zero threads", hash: "$argon2id$v=19$m=65536,t=3,p=0$" + salt + "$" + key, wantErr: true},
+		{name: "bad salt", hash: "$argon2id$v=19$m=65536,t=3,p=2$!!$" + key, wantErr: true},
+		{name: "empty key", hash: "$argon2id$v=19$m=65536,t=3,p=2$" + salt + "$", wantErr: true},
+		{name: "extra field", hash: "$argon2id$v=19$m=65536,t=3,p=2$" + salt + "$" + key + "$", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := parseArgon2Hash(tt.hash)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseArgon2Hash(%q) succeeded, want an error", tt.hash)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseArgon2Hash(%q): %v", tt.hash, err)
+			}
+			if h.time != tt.want.time || h.memory != tt.want.memory || h.threads != tt.want.threads {
+				t.Errorf("got t=%d m=%d p=%d, want t=%d m=%d p=%d", h.time, h.memory, h.threads, tt.want.time, tt.want.memory, tt.want.threads)
+			}
+			if len(h.salt) != argon2SaltLen || len(h.key) != argon2KeyLen {
+				t.Errorf("got a %d-byte salt and %d-byte key, want %d and %d", len(h.salt), len(h.key), argon2SaltLen, argon2KeyLen)
+			}
+		})
+	}
+}
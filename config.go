@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix starts the environment variable for each flag, so -max-active is
+// also read from RSD2_MAX_ACTIVE.
+const envPrefix = "RSD2_"
+
+// reloadableSettings are the flags re-read from the config file and the
+// environment on SIGHUP. The rest only take effect on a restart.
+var reloadableSettings = []string{"max-active", "max-download-rate", "max-upload-rate"}
+
+// settings holds the values read from a config file, keyed by flag name.
+type settings struct {
+	values map[string]string
+	// users are the file's credentials, or nil if it has none.
+	users map[string]string
+}
+
+// loadSettings reads a YAML, TOML or JSON config file, told apart by its
+// extension. Keys are flag names, in either -dash or _underscore form, plus
+// "users", a map of user names to password hashes or passwords.
+func loadSettings(path string) (*settings, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	raw := make(map[string]any)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		// Keeps large byte rates from turning into floats
+		decoder.UseNumber()
+		err = decoder.Decode(&raw)
+	default:
+		return nil, fmt.Errorf("unknown config file format %q: use .yaml, .toml or .json", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	s := &settings{values: make(map[string]string)}
+	for key, value := range raw {
+		name := strings.ReplaceAll(key, "_", "-")
+		if name == "users" {
+			if s.users, err = parseUsers(value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if name == "config" || flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("unknown setting %q in config file", key)
+		}
+		s.values[name] = fmt.Sprint(value)
+	}
+
+	return s, nil
+}
+
+// parseUsers reads the config file's map of user names to password hashes or
+// passwords.
+func parseUsers(value any) (map[string]string, error) {
+	entries, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("users must map user names to passwords")
+	}
+
+	users := make(map[string]string)
+	for user, pass := range entries {
+		password, ok := pass.(string)
+		if !ok || user == "" || password == "" {
+			return nil, fmt.Errorf("user %q needs a non-empty password", user)
+		}
+		users[user] = password
+	}
+	return users, nil
+}
+
+// envName is the environment variable that sets the named flag.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applySettings sets each named flag that was not given on the command line
+// from its RSD2_* environment variable, else from the config file, else back
+// to its default. s may be nil when there is no config file. Every value is
+// parsed before any flag is set, so an invalid one leaves them all as they
+// were.
+func applySettings(names []string, s *settings, explicit map[string]bool) error {
+	type setting struct {
+		flag  *flag.Flag
+		value string
+	}
+	var parsed []setting
+	for _, name := range names {
+		if explicit[name] {
+			continue
+		}
+
+		f := flag.Lookup(name)
+		value := f.DefValue
+		if s != nil {
+			if fileValue, exists := s.values[name]; exists {
+				value = fileValue
+			}
+		}
+		if envValue, exists := os.LookupEnv(envName(name)); exists {
+			value = envValue
+		}
+		// Parsed into a fresh value of the flag's own type, leaving the flag
+		// untouched
+		scratch := reflect.New(reflect.TypeOf(f.Value).Elem()).Interface().(flag.Value)
+		if err := scratch.Set(value); err != nil {
+			return fmt.Errorf("invalid %s %q: %w", name, value, err)
+		}
+		parsed = append(parsed, setting{f, value})
+	}
+
+	for _, setting := range parsed {
+		if err := setting.flag.Value.Set(setting.value); err != nil {
+			return fmt.Errorf("invalid %s %q: %w", setting.flag.Name, setting.value, err)
+		}
+	}
+	return nil
+}
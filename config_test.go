@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+// Flags of the test's own, as main registers the real ones when it runs.
+var (
+	testActive = flag.Int("test-active", 3, "")
+	testRate   = flag.Int64("test-rate", 0, "")
+)
+
+func TestApplySettings(t *testing.T) {
+	tests := []struct {
+		name       string
+		explicit   map[string]bool
+		file       map[string]string // nil for no config file
+		env        map[string]string
+		wantActive int
+		wantRate   int64
+		wantErr    bool
+	}{
+		{
+			name:       "defaults",
+			wantActive: 3,
+			wantRate:   0,
+		},
+		{
+			name:       "file",
+			file:       map[string]string{"test-active": "5"},
+			wantActive: 5,
+			wantRate:   0,
+		},
+		{
+			name:       "environment over file",
+			file:       map[string]string{"test-active": "5", "test-rate": "100"},
+			env:        map[string]string{"RSD2_TEST_ACTIVE": "7"},
+			wantActive: 7,
+			wantRate:   100,
+		},
+		{
+			name:       "flag over environment and file",
+			explicit:   map[string]bool{"test-active": true},
+			file:       map[string]string{"test-active": "5", "test-rate": "100"},
+			env:        map[string]string{"RSD2_TEST_ACTIVE": "7"},
+			wantActive: 10,
+			wantRate:   100,
+		},
+		{
+			name:       "environment without file",
+			env:        map[string]string{"RSD2_TEST_RATE": "200"},
+			wantActive: 3,
+			wantRate:   200,
+		},
+		{
+			name:       "invalid value changes nothing",
+			file:       map[string]string{"test-active": "5"},
+			env:        map[string]string{"RSD2_TEST_RATE": "fast"},
+			wantActive: 10,
+			wantRate:   10,
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// As if set on the command line or by an earlier load
+			*testActive = 10
+			*testRate = 10
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			var s *settings
+			if tt.file != nil {
+				s = &settings{values: tt.file}
+			}
+
+			err := applySettings([]string{"test-active", "test-rate"}, s, tt.explicit)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applySettings returned %v, want error: %v", err, tt.wantErr)
+			}
+			if *testActive != tt.wantActive || *testRate != tt.wantRate {
+				t.Errorf("got test-active %d and test-rate %d, want %d and %d", *testActive, *testRate, tt.wantActive, tt.wantRate)
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package engine
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// throttleInterval is how often per-job rate limits are enforced.
+	throttleInterval = 250 * time.Millisecond
+	// minRateLimitBurst is the least burst given to the client's rate limiters,
+	// enough for a full read frame or piece request.
+	minRateLimitBurst = 1 << 20
+)
+
+// clientManager owns the single torrent client shared by every download in
+// the process, so all jobs use one listen port, DHT node and peer table.
+type clientManager struct {
+	client          *torrent.Client
+	mu              sync.Mutex
+	torrents        map[JobID]*torrent.Torrent // Map to store the torrent for each job
+	throttles       map[JobID]*jobThrottle     // Map to store the rate limits of each job that has any
+	limits          RateLimits
+	downloadLimiter *rate.Limiter
+	uploadLimiter   *rate.Limiter
+	dropping        int        // Removed torrents still being dropped
+	dropped         *sync.Cond // Signalled on mu as each drop finishes
+	wake            chan struct{}
+	closed          chan struct{}
+}
+
+func newClientManager(config Config) (*clientManager, error) {
+	clientConfig := torrent.NewDefaultClientConfig()
+	clientConfig.DataDir = config.DownloadDir
+	clientConfig.ListenPort = 0 // Allow the client to choose an available port
+	clientConfig.Seed = true
+	clientConfig.NoDHT = config.NoDHT
+	clientConfig.NoDefaultPortForwarding = config.NoPortForwarding
+	// Our own limiters, so they can be adjusted while the client runs
+	clientConfig.DownloadRateLimiter = rate.NewLimiter(rate.Inf, minRateLimitBurst)
+	clientConfig.UploadRateLimiter = rate.NewLimiter(rate.Inf, minRateLimitBurst)
+
+	client, err := torrent.NewClient(clientConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create torrent client: %w", err)
+	}
+
+	m := &clientManager{
+		client:          client,
+		torrents:        make(map[JobID]*torrent.Torrent),
+		throttles:       make(map[JobID]*jobThrottle),
+		downloadLimiter: clientConfig.DownloadRateLimiter,
+		uploadLimiter:   clientConfig.UploadRateLimiter,
+		wake:            make(chan struct{}, 1),
+		closed:          make(chan struct{}),
+	}
+	m.dropped = sync.NewCond(&m.mu)
+	m.SetLimits(config.Limits)
+	go m.throttle()
+
+	return m, nil
+}
+
+// Limits returns the rate limits that apply to the client as a whole.
+func (m *clientManager) Limits() RateLimits {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.limits
+}
+
+// SetLimits changes the client-wide rate limits. Running downloads pick them
+// up straight away.
+func (m *clientManager) SetLimits(limits RateLimits) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.limits = limits
+	setRateLimit(m.downloadLimiter, limits.DownloadRateLimit)
+	setRateLimit(m.uploadLimiter, limits.UploadRateLimit)
+}
+
+func setRateLimit(limiter *rate.Limiter, bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		limiter.SetLimit(rate.Inf)
+		return
+	}
+	limiter.SetLimit(rate.Limit(bytesPerSecond))
+	limiter.SetBurst(max(int(bytesPerSecond), minRateLimitBurst))
+}
+
+// SetJobLimits sets the job's own rate limits, on top of the client-wide ones.
+// They last until the job's torrent is removed. It never touches the torrent
+// itself, so it may be called while holding the Manager's mu.
+func (m *clientManager) SetJobLimits(jobID JobID, limits RateLimits) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if th, exists := m.throttles[jobID]; exists {
+		th.limits = limits
+		// Lifted limits take effect now rather than on the next tick
+		select {
+		case m.wake <- struct{}{}:
+		default:
+		}
+		return
+	}
+	if limits != (RateLimits{}) {
+		m.throttles[jobID] = &jobThrottle{limits: limits}
+	}
+}
+
+// throttle enforces the per-job rate limits, which the torrent client has no
+// notion of, by pausing a torrent's transfers while it is over its budget.
+// Reading a torrent's stats and pausing its transfers both wait on the
+// torrent client's lock, so they happen outside mu.
+func (m *clientManager) throttle() {
+	ticker := time.NewTicker(throttleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.closed:
+			return
+		case <-ticker.C:
+		case <-m.wake:
+		}
+
+		m.mu.Lock()
+		throttled := make(map[*jobThrottle]*torrent.Torrent)
+		for jobID, th := range m.throttles {
+			if t, exists := m.torrents[jobID]; exists {
+				throttled[th] = t
+			}
+		}
+		m.mu.Unlock()
+
+		samples := make(map[*jobThrottle]transferSample, len(throttled))
+		for th, t := range throttled {
+			samples[th] = takeTransferSample(t)
+		}
+
+		m.mu.Lock()
+		for th := range throttled {
+			th.update(samples[th])
+		}
+		m.mu.Unlock()
+
+		for th, t := range throttled {
+			th.apply(t)
+		}
+	}
+}
+
+// AddMagnet adds the magnet to the shared client and records it against the job.
+func (m *clientManager) AddMagnet(jobID JobID, magnetURI string) (*torrent.Torrent, error) {
+	m.waitForDrops()
+	t, err := m.client.AddMagnet(magnetURI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add magnet URI: %w", err)
+	}
+
+	m.mu.Lock()
+	m.torrents[jobID] = t
+	m.mu.Unlock()
+
+	return t, nil
+}
+
+// AddTorrentFile adds a .torrent file to the shared client. Its info is known
+// up front, so there is no wait for metadata from peers.
+func (m *clientManager) AddTorrentFile(jobID JobID, torrentFile string) (*torrent.Torrent, error) {
+	m.waitForDrops()
+	t, err := m.client.AddTorrentFromFile(torrentFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add torrent file: %w", err)
+	}
+
+	m.mu.Lock()
+	m.torrents[jobID] = t
+	m.mu.Unlock()
+
+	return t, nil
+}
+
+// Torrent returns the job's torrent, if it is on the client.
+func (m *clientManager) Torrent(jobID JobID) (*torrent.Torrent, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, exists := m.torrents[jobID]
+	return t, exists
+}
+
+// Remove drops the job's torrent from the client, closing its peer
+// connections. The client hands out one torrent per info hash, so one that
+// another job still holds is left running for that job. Dropping waits on
+// the torrent client's lock, so it carries on in the background and Remove
+// may be called while holding the Manager's mu; adding a torrent waits for
+// it to finish, so the client never hands back one being dropped.
+func (m *clientManager) Remove(jobID JobID) {
+	m.remove(jobID, nil)
+}
+
+// RemoveTorrent is Remove for a job whose torrent is still t, so a run of
+// the job that was stopped never drops the torrent of the run after it.
+func (m *clientManager) RemoveTorrent(jobID JobID, t *torrent.Torrent) {
+	m.remove(jobID, t)
+}
+
+func (m *clientManager) remove(jobID JobID, only *torrent.Torrent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, exists := m.torrents[jobID]
+	if !exists || only != nil && t != only {
+		return
+	}
+	delete(m.torrents, jobID)
+	delete(m.throttles, jobID)
+	for _, other := range m.torrents {
+		if other == t {
+			return
+		}
+	}
+
+	m.dropping++
+	go func() {
+		t.Drop()
+		m.mu.Lock()
+		m.dropping--
+		m.dropped.Broadcast()
+		m.mu.Unlock()
+	}()
+}
+
+// waitForDrops waits until every torrent removed so far has been dropped.
+func (m *clientManager) waitForDrops() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for m.dropping > 0 {
+		m.dropped.Wait()
+	}
+}
+
+func (m *clientManager) Close() {
+	close(m.closed)
+	m.waitForDrops()
+	m.client.Close()
+}
+
+// jobThrottle is a token bucket per direction, refilled at the job's limit
+// and drained by the bytes its torrent actually moved. Its limits are guarded
+// by the clientManager's mu; the rest belongs to the throttle goroutine.
+type jobThrottle struct {
+	limits           RateLimits
+	last             transferSample
+	downloadBudget   float64
+	uploadBudget     float64
+	disableDownload  bool // Whether update wants each direction paused
+	disableUpload    bool
+	downloadDisabled bool // Whether apply has paused each direction
+	uploadDisabled   bool
+}
+
+// update refills and drains the budgets up to the sample and decides which
+// directions to pause. The caller must hold the clientManager's mu.
+func (th *jobThrottle) update(sample transferSample) {
+	if !th.last.at.IsZero() {
+		elapsed := sample.at.Sub(th.last.at).Seconds()
+		th.downloadBudget = refillBudget(th.downloadBudget, th.limits.DownloadRateLimit, elapsed, sample.downloaded-th.last.downloaded)
+		th.uploadBudget = refillBudget(th.uploadBudget, th.limits.UploadRateLimit, elapsed, sample.uploaded-th.last.uploaded)
+	}
+	th.last = sample
+	th.disableDownload = th.limits.DownloadRateLimit > 0 && th.downloadBudget < 0
+	th.disableUpload = th.limits.UploadRateLimit > 0 && th.uploadBudget < 0
+}
+
+// refillBudget adds the tokens earned over elapsed seconds, holding at most
+// one second's worth, and takes off the bytes used.
+func refillBudget(budget float64, limit int64, elapsed float64, used int64) float64 {
+	if limit <= 0 {
+		return 0
+	}
+	return min(budget+float64(limit)*elapsed, float64(limit)) - float64(used)
+}
+
+// apply pauses each direction that update found limited and over budget,
+// and resumes the others.
+func (th *jobThrottle) apply(t *torrent.Torrent) {
+	if th.disableDownload != th.downloadDisabled {
+		th.downloadDisabled = th.disableDownload
+		if th.downloadDisabled {
+			t.DisallowDataDownload()
+		} else {
+			t.AllowDataDownload()
+		}
+	}
+
+	if th.disableUpload != th.uploadDisabled {
+		th.uploadDisabled = th.disableUpload
+		if th.uploadDisabled {
+			t.DisallowDataUpload()
+		} else {
+			t.AllowDataUpload()
+		}
+	}
+}
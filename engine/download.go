@@ -0,0 +1,434 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+// progressInterval is how often progress is recomputed from verified pieces.
+const progressInterval = 500 * time.Millisecond
+
+// downloadTorrent fetches the job's selected files until they are complete or
+// ctx is cancelled. When retryAllowed is set, a stall is returned as
+// errStalled so the caller can re-add the torrent; otherwise the job is
+// marked stalled and keeps waiting for peers.
+func (m *Manager) downloadTorrent(ctx context.Context, job *Job, retryAllowed bool) error {
+	jobID := job.ID
+
+	var t *torrent.Torrent
+	var err error
+	if job.TorrentFile != "" {
+		t, err = m.client.AddTorrentFile(jobID, job.TorrentFile)
+	} else {
+		t, err = m.client.AddMagnet(jobID, job.MagnetURI)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Every change to the job below is made under mu and only while ctx is
+	// live, so a job that has been paused or cancelled keeps that status.
+	m.mu.Lock()
+	if ctx.Err() != nil {
+		// Stopped while the torrent was being added, too late for
+		// stopDownload to drop it. If the job has been started again, the
+		// new run may hold this same torrent and drops it when done.
+		if _, running := m.downloads[jobID]; !running {
+			m.client.RemoveTorrent(jobID, t)
+		}
+		m.mu.Unlock()
+		return ctx.Err()
+	}
+	m.client.SetJobLimits(jobID, job.RateLimits)
+	job.Status = StatusFetchingMetadata
+	job.InfoHash = t.InfoHash().HexString()
+	job.Name = t.Name()
+	m.jobChanged(job)
+	m.mu.Unlock()
+
+	var metadataDeadline <-chan time.Time
+	if m.config.MetadataTimeout > 0 {
+		timer := time.NewTimer(m.config.MetadataTimeout)
+		defer timer.Stop()
+		metadataDeadline = timer.C
+	}
+
+	select {
+	case <-t.GotInfo():
+	case <-metadataDeadline:
+		return fmt.Errorf("%w after %s", errMetadataTimeout, m.config.MetadataTimeout)
+	case <-t.Closed():
+		return errTorrentDropped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// Record the files so they are known after a restart. A resumed job
+	// keeps its earlier selection.
+	m.mu.Lock()
+	if ctx.Err() != nil {
+		m.mu.Unlock()
+		return ctx.Err()
+	}
+	job.Name = t.Name()
+	if len(job.Files) == 0 {
+		for _, file := range t.Files() {
+			job.Files = append(job.Files, JobFile{
+				Path:     file.Path(),
+				Length:   file.Length(),
+				Selected: true,
+			})
+		}
+	}
+	selectionChan := m.selections[jobID]
+	waitForSelection := job.SelectFiles
+	if waitForSelection {
+		job.Status = StatusSelectingFiles
+	} else {
+		job.Status = StatusDownloading
+	}
+	m.saveState()
+	m.jobChanged(job)
+	m.mu.Unlock()
+
+	// Wait for the user to choose which files to download
+	if waitForSelection {
+		select {
+		case <-selectionChan:
+		case <-t.Closed():
+			return errTorrentDropped
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// Calculate the total size of the selected files
+	m.mu.Lock()
+	var totalSize int64
+	var selectedFiles []*torrent.File
+	for i, file := range t.Files() {
+		if job.Files[i].Selected {
+			totalSize += file.Length()
+			selectedFiles = append(selectedFiles, file)
+		}
+	}
+	job.TotalSizeBytes = totalSize
+	verified := m.verified[jobID]
+	m.mu.Unlock()
+
+	// Re-hash the selected files' data on disk the first time the job
+	// starts in this process, as it may have changed while nothing was
+	// running, so only missing pieces are fetched. Later starts trust the
+	// piece states the client has kept since.
+	if !verified {
+		if err := verifyFiles(ctx, t, selectedFiles); err != nil {
+			return fmt.Errorf("failed to verify existing data: %w", err)
+		}
+		m.mu.Lock()
+		if ctx.Err() == nil {
+			m.verified[jobID] = true
+		}
+		m.mu.Unlock()
+	}
+
+	// Download the selected files. The client's storage writes pieces
+	// straight into the download directory.
+	for _, file := range selectedFiles {
+		file.Download()
+	}
+
+	if err := m.waitForPieces(ctx, t, selectedFiles, job, retryAllowed); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// waitForPieces reports progress from verified pieces until the files are
+// complete or ctx is cancelled. A download that receives no data for the
+// stall timeout is either returned as errStalled or marked stalled.
+func (m *Manager) waitForPieces(ctx context.Context, t *torrent.Torrent, files []*torrent.File, job *Job, retryAllowed bool) error {
+	progress := job.ProgressResponse
+	stallTimeout := m.config.StallTimeout
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	lastChange := time.Now()
+	stalled := false
+	sample := takeTransferSample(t)
+	lastReceived := sample.downloaded
+
+	for {
+		// Read before taking mu, as they wait on the torrent client's lock
+		downloaded := verifiedBytes(files)
+		stats := readTorrentStats(t, files)
+
+		m.mu.Lock()
+		if ctx.Err() != nil {
+			m.mu.Unlock()
+			return ctx.Err()
+		}
+		progress.DownloadedBytes = downloaded
+		if progress.TotalSizeBytes > 0 {
+			progress.Progress = int(float64(downloaded) / float64(progress.TotalSizeBytes) * 100)
+		}
+		sample = updateTransferStats(progress, sample, stats)
+		if downloaded >= progress.TotalSizeBytes {
+			m.jobChanged(job)
+			m.mu.Unlock()
+			return nil
+		}
+
+		// Counts data as it arrives rather than as pieces verify, since a
+		// large piece on a slow or rate-limited link can take longer than the
+		// stall timeout to complete
+		if sample.downloaded != lastReceived {
+			lastReceived = sample.downloaded
+			lastChange = time.Now()
+			if stalled {
+				stalled = false
+				job.Status = StatusDownloading
+				job.Error = ""
+			}
+		} else if stallTimeout > 0 && !stalled && time.Since(lastChange) >= stallTimeout {
+			reason := fmt.Sprintf("no data received for %s", stallTimeout)
+			if retryAllowed {
+				m.mu.Unlock()
+				return fmt.Errorf("%w: %s", errStalled, reason)
+			}
+
+			log.Printf("Download stalled: %s", reason)
+			stalled = true
+			job.Status = StatusStalled
+			job.Error = reason
+		}
+		m.jobChanged(job)
+		m.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.Closed():
+			return errTorrentDropped
+		case <-ticker.C:
+		}
+	}
+}
+
+// transferSample is a snapshot of a torrent's byte counters, from which
+// transfer rates are derived.
+type transferSample struct {
+	at         time.Time
+	downloaded int64
+	uploaded   int64
+}
+
+func takeTransferSample(t *torrent.Torrent) transferSample {
+	stats := t.Stats()
+	return transferSample{
+		at:         time.Now(),
+		downloaded: stats.BytesReadUsefulData.Int64(),
+		uploaded:   stats.BytesWrittenData.Int64(),
+	}
+}
+
+// torrentStats are what a job's progress reports about its torrent. They are
+// read without holding the Manager's mu, as reading them waits on the torrent
+// client's lock.
+type torrentStats struct {
+	sample       transferSample
+	peers        int
+	totalPeers   int
+	seeders      int
+	availability float64
+}
+
+func readTorrentStats(t *torrent.Torrent, files []*torrent.File) torrentStats {
+	stats := t.Stats()
+	return torrentStats{
+		sample: transferSample{
+			at:         time.Now(),
+			downloaded: stats.BytesReadUsefulData.Int64(),
+			uploaded:   stats.BytesWrittenData.Int64(),
+		},
+		peers:        stats.ActivePeers,
+		totalPeers:   stats.TotalPeers,
+		seeders:      stats.ConnectedSeeders,
+		availability: availability(t, files),
+	}
+}
+
+// updateTransferStats fills in the rates, ratio, ETA and peer statistics from
+// the torrent's stats and the counters since the previous sample, and returns
+// the new sample. The caller must hold the Manager's mu.
+func updateTransferStats(progress *ProgressResponse, last transferSample, stats torrentStats) transferSample {
+	sample := stats.sample
+	if elapsed := sample.at.Sub(last.at).Seconds(); elapsed > 0 {
+		progress.DownloadRate = int64(float64(sample.downloaded-last.downloaded) / elapsed)
+		progress.UploadRate = int64(float64(sample.uploaded-last.uploaded) / elapsed)
+	}
+	// Counted from the previous sample, so uploads add up across re-adds
+	progress.UploadedBytes += sample.uploaded - last.uploaded
+	if progress.TotalSizeBytes > 0 {
+		progress.Ratio = float64(progress.UploadedBytes) / float64(progress.TotalSizeBytes)
+	}
+
+	progress.ETASeconds = -1
+	if progress.DownloadRate > 0 {
+		progress.ETASeconds = (progress.TotalSizeBytes - progress.DownloadedBytes) / progress.DownloadRate
+	}
+
+	progress.Peers = stats.peers
+	progress.TotalPeers = stats.totalPeers
+	progress.Seeders = stats.seeders
+	progress.Availability = stats.availability
+
+	return sample
+}
+
+// seedJob keeps a finished download's torrent seeding until it reaches the
+// seed ratio or has seeded for the seed time, then applies the seed action.
+// It returns early if the job is dismissed or the Manager closed in the
+// meantime.
+func (m *Manager) seedJob(job *Job) {
+	t, exists := m.client.Torrent(job.ID)
+	if !exists {
+		return
+	}
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	sample := takeTransferSample(t)
+	var seededFor time.Duration
+	for first := true; ; first = false {
+		// The files are complete, so there is nothing missing to be available
+		stats := readTorrentStats(t, nil)
+
+		m.mu.Lock()
+		if m.jobs[job.ID] != job || job.Status != StatusSeeding {
+			m.mu.Unlock()
+			return
+		}
+		if first {
+			// Carry on from the time seeded in earlier runs
+			seededFor = time.Duration(job.SeedingSeconds) * time.Second
+		}
+		last := sample
+		sample = updateTransferStats(job.ProgressResponse, last, stats)
+		seededFor += sample.at.Sub(last.at)
+		job.SeedingSeconds = int64(seededFor / time.Second)
+		if m.seedGoalReached(job) {
+			m.finishSeeding(job)
+			m.mu.Unlock()
+			return
+		}
+		m.jobChanged(job)
+		m.mu.Unlock()
+
+		select {
+		case <-t.Closed():
+			// Dismissed, which already took care of the job
+			return
+		case <-m.closed:
+			// Still seeding, so it carries on once the state is loaded again
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// seedGoalReached reports whether the job has seeded enough under the seeding
+// policy. With neither limit set it seeds until dismissed.
+func (m *Manager) seedGoalReached(job *Job) bool {
+	if m.config.SeedRatio > 0 && job.Ratio >= m.config.SeedRatio {
+		return true
+	}
+	return m.config.SeedTime > 0 && time.Duration(job.SeedingSeconds)*time.Second >= m.config.SeedTime
+}
+
+// finishSeeding takes the job's torrent off the client and, depending on the
+// seed action, marks the job completed or drops it from the list. The caller
+// must hold mu.
+func (m *Manager) finishSeeding(job *Job) {
+	m.client.Remove(job.ID)
+	delete(m.verified, job.ID)
+	log.Printf("Seeding finished at ratio %.2f after %s: %s", job.Ratio, time.Duration(job.SeedingSeconds)*time.Second, job.Name)
+
+	job.Status = StatusCompleted
+	job.DownloadRate = 0
+	job.UploadRate = 0
+	job.Peers = 0
+	job.Seeders = 0
+	if m.config.SeedAction == SeedActionRemove {
+		delete(m.jobs, job.ID)
+		m.publish(Event{Type: EventJobRemoved, Job: job.snapshot()})
+	} else {
+		m.jobChanged(job)
+	}
+	m.saveState()
+}
+
+// availability is the percentage of the files' missing pieces that at least
+// one connected peer has. Anything below 100 means the download cannot finish
+// with the peers currently connected.
+func availability(t *torrent.Torrent, files []*torrent.File) float64 {
+	seen := make(map[int]bool)
+	var missing []int
+	for _, file := range files {
+		for i := file.BeginPieceIndex(); i < file.EndPieceIndex(); i++ {
+			if !seen[i] && !t.PieceState(i).Complete {
+				missing = append(missing, i)
+			}
+			seen[i] = true
+		}
+	}
+	if len(missing) == 0 {
+		return 100
+	}
+
+	available := make(map[int]bool)
+	for _, peerConn := range t.PeerConns() {
+		peerPieces := peerConn.PeerPieces()
+		for _, i := range missing {
+			if peerPieces.Contains(uint32(i)) {
+				available[i] = true
+			}
+		}
+	}
+
+	return float64(len(available)) / float64(len(missing)) * 100
+}
+
+// verifyFiles re-hashes the pieces that hold data of the given files, which
+// are in torrent order. A piece shared by two files is hashed once.
+func verifyFiles(ctx context.Context, t *torrent.Torrent, files []*torrent.File) error {
+	next := 0
+	for _, file := range files {
+		for i := max(file.BeginPieceIndex(), next); i < file.EndPieceIndex(); i++ {
+			if err := t.Piece(i).VerifyDataContext(ctx); err != nil {
+				return fmt.Errorf("verifying piece %d: %w", i, err)
+			}
+			next = i + 1
+		}
+	}
+	return nil
+}
+
+// verifiedBytes sums the bytes of the files that lie in pieces which have
+// passed their hash check.
+func verifiedBytes(files []*torrent.File) int64 {
+	var n int64
+	for _, file := range files {
+		for _, state := range file.State() {
+			if state.Complete {
+				n += state.Bytes
+			}
+		}
+	}
+	return n
+}
@@ -0,0 +1,144 @@
+package engine
+
+import (
+	"context"
+	"sync"
+)
+
+// EventType says what an Event reports.
+type EventType string
+
+const (
+	EventJobAdded         EventType = "job_added"
+	EventJobUpdated       EventType = "job_updated"
+	EventJobRemoved       EventType = "job_removed"
+	EventBandwidthChanged EventType = "bandwidth_changed"
+)
+
+// Event reports a change to a job, with a copy of the job as it now is, or
+// to the bandwidth profile or global limits, with the new BandwidthStatus.
+type Event struct {
+	Type      EventType
+	Job       *Job
+	Bandwidth *BandwidthStatus
+}
+
+// subscriber holds the events not yet taken by a Subscribe caller. While
+// they wait, a newer event about the same job or about the bandwidth
+// replaces the older one, so a slow reader never blocks the Manager and
+// still ends up with the latest state.
+type subscriber struct {
+	events  chan Event
+	wake    chan struct{}
+	mu      sync.Mutex
+	pending []Event
+}
+
+// Subscribe returns a channel of every change from now on. The channel is
+// closed once ctx is done or the Manager is closed. Updates to a job that
+// arrive faster than they are read are merged into the latest one.
+func (m *Manager) Subscribe(ctx context.Context) <-chan Event {
+	s := &subscriber{
+		events: make(chan Event),
+		wake:   make(chan struct{}, 1),
+	}
+
+	m.mu.Lock()
+	m.subscribers[s] = true
+	m.mu.Unlock()
+
+	go func() {
+		defer close(s.events)
+		s.deliver(ctx, m.closed)
+
+		m.mu.Lock()
+		delete(m.subscribers, s)
+		m.mu.Unlock()
+	}()
+
+	return s.events
+}
+
+// deliver hands the pending events to the reader in order until ctx is done
+// or closed is closed.
+func (s *subscriber) deliver(ctx context.Context, closed <-chan struct{}) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-closed:
+			return
+		case <-s.wake:
+		}
+
+		for {
+			s.mu.Lock()
+			if len(s.pending) == 0 {
+				s.mu.Unlock()
+				break
+			}
+			event := s.pending[0]
+			s.pending = s.pending[1:]
+			s.mu.Unlock()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-closed:
+				return
+			case s.events <- event:
+			}
+		}
+	}
+}
+
+// push queues the event, merging it into a pending one about the same job or
+// about the bandwidth.
+func (s *subscriber) push(event Event) {
+	s.mu.Lock()
+	merged := false
+	for i := range s.pending {
+		pending := &s.pending[i]
+		if pending.Job == nil && event.Job == nil || pending.Job != nil && event.Job != nil && pending.Job.ID == event.Job.ID {
+			// A job the reader has not heard of yet is still new to it
+			if pending.Type != EventJobAdded || event.Type != EventJobUpdated {
+				pending.Type = event.Type
+			}
+			pending.Job = event.Job
+			pending.Bandwidth = event.Bandwidth
+			merged = true
+			break
+		}
+	}
+	if !merged {
+		s.pending = append(s.pending, event)
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+		// A wake-up is already pending
+	}
+}
+
+// publish sends the event to every subscriber. The caller must hold mu.
+func (m *Manager) publish(event Event) {
+	for s := range m.subscribers {
+		s.push(event)
+	}
+}
+
+// jobChanged publishes an update with a copy of the job. The caller must hold
+// mu.
+func (m *Manager) jobChanged(job *Job) {
+	if len(m.subscribers) > 0 {
+		m.publish(Event{Type: EventJobUpdated, Job: job.snapshot()})
+	}
+}
+
+// bandwidthChanged publishes the bandwidth status. The caller must hold mu.
+func (m *Manager) bandwidthChanged() {
+	status := m.bandwidthStatus()
+	m.publish(Event{Type: EventBandwidthChanged, Bandwidth: &status})
+}
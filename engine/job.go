@@ -0,0 +1,183 @@
+// Package engine downloads torrents as jobs on a single shared torrent
+// client. It queues them behind a concurrency limit, enforces global and
+// per-job rate limits, seeds finished downloads and keeps every job in a
+// state file so unfinished ones resume after a restart.
+//
+// A Manager runs the jobs:
+//
+//	m, err := engine.New(engine.Config{DownloadDir: dir})
+//	if err != nil {
+//		return err
+//	}
+//	defer m.Close()
+//
+//	events := m.Subscribe(ctx)
+//	jobID, err := m.Add(ctx, engine.Source{URI: magnetURI})
+//	for event := range events {
+//		if event.Job != nil && event.Job.ID == jobID && engine.IsFinished(event.Job.Status) {
+//			break
+//		}
+//	}
+package engine
+
+import (
+	"errors"
+	"io"
+	"slices"
+	"time"
+)
+
+type ProgressResponse struct {
+	Status          string     `json:"status"`
+	Error           string     `json:"error,omitempty"`
+	Name            string     `json:"name"`
+	InfoHash        string     `json:"info_hash"`
+	Progress        int        `json:"progress"`
+	DownloadedBytes int64      `json:"downloaded_bytes"`
+	TotalSizeBytes  int64      `json:"total_size_bytes"`
+	DownloadRate    int64      `json:"download_rate"` // Bytes per second
+	UploadRate      int64      `json:"upload_rate"`   // Bytes per second
+	UploadedBytes   int64      `json:"uploaded_bytes"`
+	Ratio           float64    `json:"ratio"` // Uploaded bytes over total size
+	SeedingSeconds  int64      `json:"seeding_seconds"`
+	ETASeconds      int64      `json:"eta_seconds"`  // -1 while the download rate is zero
+	Peers           int        `json:"peers"`        // Connected peers
+	TotalPeers      int        `json:"total_peers"`  // Known peers, connected or not
+	Seeders         int        `json:"seeders"`      // Connected peers that have everything
+	Availability    float64    `json:"availability"` // Percent of missing pieces that connected peers have
+	StartedAt       time.Time  `json:"started_at"`
+	FinishedAt      *time.Time `json:"finished_at,omitempty"`
+}
+
+const (
+	StatusQueued           = "queued"
+	StatusFetchingMetadata = "fetching_metadata"
+	StatusSelectingFiles   = "selecting_files"
+	StatusDownloading      = "downloading"
+	StatusStalled          = "stalled"
+	StatusPaused           = "paused"
+	StatusSeeding          = "seeding"
+	StatusCompleted        = "completed"
+	StatusCancelled        = "cancelled"
+	StatusFailed           = "failed"
+)
+
+// IsFinished reports whether a job in this status has stopped downloading.
+func IsFinished(status string) bool {
+	switch status {
+	case StatusSeeding, StatusCompleted, StatusCancelled, StatusFailed:
+		return true
+	}
+	return false
+}
+
+const (
+	// SeedActionStop drops a torrent that is done seeding from the client
+	// but keeps its job listed as completed.
+	SeedActionStop = "stop"
+	// SeedActionRemove also removes the job from the list. The data is kept.
+	SeedActionRemove = "remove"
+)
+
+// Errors returned by the Manager when a job cannot be found or is in the
+// wrong state for the request.
+var (
+	ErrJobNotFound       = errors.New("job not found")
+	ErrNotQueued         = errors.New("job is not queued")
+	ErrNotSelectingFiles = errors.New("job is not waiting for a file selection")
+	ErrNotRunning        = errors.New("job is not running")
+	ErrNotPaused         = errors.New("job is not paused")
+	ErrNotTransferring   = errors.New("job is no longer transferring")
+	ErrUnknownProfile    = errors.New("unknown profile")
+	ErrNoSource          = errors.New("a magnet URI, torrent URL or torrent file is required")
+	// ErrDuplicateJob is returned when adding a torrent that another job is
+	// still downloading, seeding or holding paused.
+	ErrDuplicateJob = errors.New("torrent is already added")
+	// ErrFetchTorrent wraps failures to fetch a .torrent file by URL.
+	ErrFetchTorrent = errors.New("failed to fetch torrent file")
+)
+
+var (
+	errMetadataTimeout = errors.New("timed out waiting for torrent metadata")
+	errStalled         = errors.New("download stalled")
+	errTorrentDropped  = errors.New("torrent was dropped before completing")
+)
+
+// JobID identifies a job. IDs are time-ordered, so sorting them sorts jobs
+// by when they were added.
+type JobID string
+
+// Job is a single torrent download. A session may own any number of jobs.
+type Job struct {
+	ID        JobID  `json:"id"`
+	SessionID string `json:"session_id"`
+	MagnetURI string `json:"magnet_uri"`
+	// TorrentFile is the saved .torrent for jobs added by upload; such jobs
+	// are re-added from it rather than from MagnetURI.
+	TorrentFile string    `json:"torrent_file,omitempty"`
+	Files       []JobFile `json:"files"`
+	// SelectFiles holds the download after metadata arrives until the user
+	// has chosen which files to fetch.
+	SelectFiles bool `json:"select_files"`
+	// Priority orders the queue: a new job is queued behind every job of
+	// equal or higher priority.
+	Priority int `json:"priority"`
+	// QueuePosition is the job's 1-based place in the queue, or 0 once it
+	// has been started.
+	QueuePosition int `json:"queue_position,omitempty"`
+	// RateLimits are the job's own limits, applied on top of the global ones.
+	RateLimits
+	*ProgressResponse
+}
+
+// JobFile is one file of a job's torrent, in torrent order.
+type JobFile struct {
+	Path     string `json:"path"`
+	Length   int64  `json:"length"`
+	Selected bool   `json:"selected"`
+}
+
+// Source is what a job downloads: a magnet URI, an HTTP(S) link to a
+// .torrent file, or the content of a .torrent file.
+type Source struct {
+	URI string
+	// Torrent is read as a .torrent file and is used instead of URI if set.
+	Torrent io.Reader
+	JobOptions
+}
+
+// JobOptions are the settings a job is added with.
+type JobOptions struct {
+	// SessionID records who added the job; the engine does not use it.
+	SessionID   string
+	SelectFiles bool
+	Priority    int
+	RateLimits
+}
+
+// CancelResult reports a cancelled or dismissed job and what became of its
+// data.
+type CancelResult struct {
+	Job      *Job `json:"job"`
+	KeptData bool `json:"kept_data"`
+	// Removed lists the deleted files and directories, relative to the
+	// download directory. Directories end in a slash.
+	Removed []string `json:"removed"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// RateLimits caps transfer rates in bytes per second; 0 means unlimited.
+type RateLimits struct {
+	DownloadRateLimit int64 `json:"download_rate_limit"`
+	UploadRateLimit   int64 `json:"upload_rate_limit"`
+}
+
+// snapshot copies the job so that it can be read, or encoded, after mu is
+// released. The caller must hold mu.
+func (job *Job) snapshot() *Job {
+	copied := *job
+	progress := *job.ProgressResponse
+	copied.ProgressResponse = &progress
+	copied.Files = slices.Clone(job.Files)
+	return &copied
+}
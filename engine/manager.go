@@ -0,0 +1,708 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/google/uuid"
+)
+
+const (
+	// stateSaveInterval is how often in-flight progress is written to the state file.
+	stateSaveInterval = 30 * time.Second
+	// stateFileName is the default state file, under the download directory.
+	stateFileName = ".rsd2-state.json"
+)
+
+// Config holds the settings a Manager runs with.
+type Config struct {
+	DownloadDir string
+	// StatePath is the job state file; it defaults to .rsd2-state.json in
+	// the download directory.
+	StatePath       string
+	MetadataTimeout time.Duration // How long to wait for a magnet's metadata (0 waits forever)
+	StallTimeout    time.Duration // How long a download may go without new data (0 disables)
+	Retries         int           // How often a timed out or stalled download is re-added
+	MaxActive       int           // How many downloads may run at once (0 for no limit)
+	// Limits are the global rate limits outside every bandwidth profile.
+	Limits     RateLimits
+	Schedule   []BandwidthProfile // Bandwidth profiles, in order of precedence
+	SeedRatio  float64            // Upload ratio at which seeding ends (0 for no limit)
+	SeedTime   time.Duration      // How long a finished download seeds (0 for no limit)
+	SeedAction string             // SeedActionStop or SeedActionRemove; defaults to stop
+	// NoDHT and NoPortForwarding keep the client off the DHT and stop it
+	// asking the router to forward its port, for private swarms and tests.
+	NoDHT            bool
+	NoPortForwarding bool
+	// AllowPrivateURLs lets .torrent links point at loopback, link-local and
+	// private network addresses, such as a tracker on the LAN.
+	AllowPrivateURLs bool
+}
+
+// Manager runs every job on one shared torrent client. It is safe for
+// concurrent use; the jobs it returns are copies taken under its lock.
+type Manager struct {
+	config          Config
+	client          *clientManager
+	fetchClient     *http.Client // Fetches .torrent files by URL
+	store           *JobStore
+	mu              sync.Mutex
+	jobs            map[JobID]*Job
+	downloads       map[JobID]context.CancelFunc // Map to store the cancel function of each running download
+	selections      map[JobID]chan bool          // Map to store the file selection signal for each job
+	verified        map[JobID]bool               // Jobs whose data on disk has been re-hashed since the process started
+	subscribers     map[*subscriber]bool
+	queue           []JobID        // IDs of jobs waiting for a download slot, in start order
+	activeProfile   string         // Name of the profile whose limits are in force
+	profileOverride string         // Profile chosen over the schedule, if any
+	running         sync.WaitGroup // Download and seeding goroutines, which Close waits for
+	closeOnce       sync.Once
+	closed          chan struct{}
+}
+
+// New starts the torrent client, restores the jobs in the state file and
+// resumes the unfinished ones.
+func New(config Config) (*Manager, error) {
+	if config.StatePath == "" {
+		config.StatePath = filepath.Join(config.DownloadDir, stateFileName)
+	}
+	switch config.SeedAction {
+	case "":
+		config.SeedAction = SeedActionStop
+	case SeedActionStop, SeedActionRemove:
+	default:
+		return nil, fmt.Errorf("invalid seed action %q: must be %s or %s", config.SeedAction, SeedActionStop, SeedActionRemove)
+	}
+
+	client, err := newClientManager(config)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manager{
+		config:      config,
+		client:      client,
+		fetchClient: newTorrentFetchClient(config.AllowPrivateURLs),
+		store:       NewJobStore(config.StatePath),
+		jobs:        make(map[JobID]*Job),
+		downloads:   make(map[JobID]context.CancelFunc),
+		selections:  make(map[JobID]chan bool),
+		verified:    make(map[JobID]bool),
+		subscribers: make(map[*subscriber]bool),
+		closed:      make(chan struct{}),
+	}
+	if err := m.loadState(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	// Keep the global rate limits in line with the bandwidth schedule
+	m.mu.Lock()
+	m.applyBandwidthProfile(time.Now())
+	m.mu.Unlock()
+	go m.run()
+
+	return m, nil
+}
+
+// run follows the bandwidth schedule and periodically persists progress of
+// in-flight downloads until the Manager is closed.
+func (m *Manager) run() {
+	scheduleTicker := time.NewTicker(scheduleCheckInterval)
+	defer scheduleTicker.Stop()
+	saveTicker := time.NewTicker(stateSaveInterval)
+	defer saveTicker.Stop()
+
+	for {
+		select {
+		case <-m.closed:
+			return
+		case now := <-scheduleTicker.C:
+			m.mu.Lock()
+			m.applyBandwidthProfile(now)
+			m.mu.Unlock()
+		case <-saveTicker.C:
+			m.mu.Lock()
+			m.saveState()
+			m.mu.Unlock()
+		}
+	}
+}
+
+// Close stops every download, saves the state and shuts the torrent client
+// down, closing every subscription. Unfinished jobs resume when a Manager is
+// next created on the same state file. Calling Close again does nothing.
+func (m *Manager) Close() {
+	m.closeOnce.Do(func() {
+		// The downloads are stopped before the client closes under them, so
+		// none of them is mistaken for a failure and left out of the resume
+		m.mu.Lock()
+		close(m.closed)
+		for _, cancel := range m.downloads {
+			cancel()
+		}
+		m.mu.Unlock()
+		m.running.Wait()
+
+		m.mu.Lock()
+		m.saveState()
+		m.mu.Unlock()
+
+		m.client.Close()
+	})
+}
+
+// isClosed reports whether Close has been called.
+func (m *Manager) isClosed() bool {
+	select {
+	case <-m.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// DownloadDir is the directory the jobs download into.
+func (m *Manager) DownloadDir() string {
+	return m.config.DownloadDir
+}
+
+// SetMaxActive changes how many downloads may run at once (0 for no limit).
+// Raising it starts queued jobs straight away; lowering it lets running
+// downloads finish rather than stopping them.
+func (m *Manager) SetMaxActive(maxActive int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.config.MaxActive = maxActive
+	m.startQueuedJobs()
+	m.saveState()
+}
+
+// saveState writes every job to the store. The caller must hold mu.
+func (m *Manager) saveState() {
+	state := &State{}
+	for _, job := range m.jobs {
+		state.Jobs = append(state.Jobs, job)
+	}
+
+	if err := m.store.Save(state); err != nil {
+		log.Printf("Error saving state: %v", err)
+	}
+}
+
+// loadState restores jobs from the store and restarts the unfinished ones,
+// which pick up from the data already on disk.
+func (m *Manager) loadState() error {
+	state, err := m.store.Load()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var resumed []*Job
+	for _, job := range state.Jobs {
+		m.jobs[job.ID] = job
+
+		switch job.Status {
+		case StatusPaused, StatusCompleted, StatusCancelled, StatusFailed:
+		default:
+			// Seeding jobs are re-added too; their pieces verify at once and
+			// they carry on seeding towards the seed goal
+			resumed = append(resumed, job)
+		}
+	}
+
+	// Downloads that were running go first, then the queue in its saved order
+	sort.SliceStable(resumed, func(i, j int) bool {
+		return resumed[i].QueuePosition < resumed[j].QueuePosition
+	})
+	for _, job := range resumed {
+		if job.Status == StatusSeeding {
+			log.Printf("Resuming seeding: %s", job.MagnetURI)
+		} else {
+			log.Printf("Resuming download: %s", job.MagnetURI)
+		}
+		job.Status = StatusQueued
+		m.queue = append(m.queue, job.ID)
+	}
+	m.startQueuedJobs()
+
+	return nil
+}
+
+// List returns every job, oldest first.
+func (m *Manager) List() []*Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := []*Job{}
+	for _, job := range m.jobs {
+		list = append(list, job.snapshot())
+	}
+	// Job IDs are time-ordered
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Get returns the job with the given ID.
+func (m *Manager) Get(jobID JobID) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, exists := m.jobs[jobID]
+	if !exists {
+		return nil, ErrJobNotFound
+	}
+	return job.snapshot(), nil
+}
+
+// Add queues a new job and starts it as soon as a download slot is free. A
+// .torrent file given by URL is fetched first, within ctx; ctx does not
+// bound the download itself. A torrent that another job has not finished
+// with yet is refused with ErrDuplicateJob, as both would share its data.
+func (m *Manager) Add(ctx context.Context, source Source) (JobID, error) {
+	torrentFile, magnetURI, err := source.resolve(ctx, m.fetchClient, m.config.DownloadDir)
+	if err != nil {
+		return "", err
+	}
+	// Known up front for everything but magnets without a v1 info hash,
+	// which are left to the client
+	var infoHash string
+	if magnet, err := metainfo.ParseMagnetUri(magnetURI); err == nil {
+		infoHash = magnet.InfoHash.HexString()
+	}
+
+	job := &Job{
+		ID:          JobID(uuid.Must(uuid.NewV7()).String()),
+		SessionID:   source.SessionID,
+		MagnetURI:   magnetURI,
+		TorrentFile: torrentFile,
+		SelectFiles: source.SelectFiles,
+		Priority:    source.Priority,
+		RateLimits:  source.RateLimits,
+		ProgressResponse: &ProgressResponse{
+			Status:    StatusQueued,
+			InfoHash:  infoHash,
+			StartedAt: time.Now(),
+		},
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, other := range m.jobs {
+		switch other.Status {
+		case StatusCompleted, StatusCancelled, StatusFailed:
+			// Its torrent is off the client, so a new job has it to itself
+		default:
+			if infoHash != "" && other.InfoHash == infoHash {
+				return "", ErrDuplicateJob
+			}
+		}
+	}
+
+	m.publish(Event{Type: EventJobAdded, Job: job.snapshot()})
+	m.enqueueJob(job)
+	m.saveState()
+	return job.ID, nil
+}
+
+// update looks up a job, applies change to it under mu and, if that
+// succeeds, saves and publishes the result.
+func (m *Manager) update(jobID JobID, change func(job *Job) error) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, exists := m.jobs[jobID]
+	if !exists {
+		return nil, ErrJobNotFound
+	}
+	if err := change(job); err != nil {
+		return nil, err
+	}
+	m.saveState()
+	m.jobChanged(job)
+	return job.snapshot(), nil
+}
+
+// SetJobLimits changes a job's own rate limits while it runs or seeds.
+func (m *Manager) SetJobLimits(jobID JobID, limits RateLimits) (*Job, error) {
+	return m.update(jobID, func(job *Job) error {
+		if job.Status == StatusCompleted || job.Status == StatusCancelled || job.Status == StatusFailed {
+			return ErrNotTransferring
+		}
+		job.RateLimits = limits
+		m.client.SetJobLimits(job.ID, limits)
+		return nil
+	})
+}
+
+// Move reorders a queued job; to is top, up, down or bottom.
+func (m *Manager) Move(jobID JobID, to string) (*Job, error) {
+	return m.update(jobID, func(job *Job) error {
+		return m.moveQueuedJob(job, to)
+	})
+}
+
+// SelectFiles applies the file indices chosen for a job that is waiting on a
+// file selection and lets its download start.
+func (m *Manager) SelectFiles(jobID JobID, indices []int) (*Job, error) {
+	return m.update(jobID, func(job *Job) error {
+		if job.Status != StatusSelectingFiles {
+			return ErrNotSelectingFiles
+		}
+
+		selected := make(map[int]bool)
+		for _, index := range indices {
+			if index < 0 || index >= len(job.Files) {
+				return fmt.Errorf("invalid file index %d", index)
+			}
+			selected[index] = true
+		}
+		if len(selected) == 0 {
+			return fmt.Errorf("at least one file must be selected")
+		}
+
+		for i := range job.Files {
+			job.Files[i].Selected = selected[i]
+		}
+		job.SelectFiles = false
+		job.Status = StatusDownloading
+		close(m.selections[job.ID])
+		delete(m.selections, job.ID)
+		return nil
+	})
+}
+
+// Pause stops a queued, running or seeding job's transfers and disconnects
+// its peers, keeping its data on disk.
+func (m *Manager) Pause(jobID JobID) (*Job, error) {
+	return m.update(jobID, func(job *Job) error {
+		if job.Status == StatusPaused || IsFinished(job.Status) && job.Status != StatusSeeding {
+			return ErrNotRunning
+		}
+
+		m.stopDownload(job)
+		job.Status = StatusPaused
+		job.Error = ""
+		job.DownloadRate = 0
+		job.UploadRate = 0
+		job.ETASeconds = -1
+		job.Peers = 0
+		job.Seeders = 0
+		return nil
+	})
+}
+
+// Resume queues a paused job again. Once started, its torrent is re-added
+// and only the pieces that fail verification are fetched.
+func (m *Manager) Resume(jobID JobID) (*Job, error) {
+	return m.update(jobID, func(job *Job) error {
+		if job.Status != StatusPaused {
+			return ErrNotPaused
+		}
+		m.enqueueJob(job)
+		return nil
+	})
+}
+
+// Cancel stops an active job and keeps it listed as cancelled. A job that
+// has already finished is removed from the list instead. Unless keepData is
+// set, every file of the job is deleted along with the directories this
+// leaves empty.
+func (m *Manager) Cancel(jobID JobID, keepData bool) (*CancelResult, error) {
+	m.mu.Lock()
+	job, exists := m.jobs[jobID]
+	if !exists {
+		m.mu.Unlock()
+		return nil, ErrJobNotFound
+	}
+
+	event := Event{Type: EventJobUpdated}
+	if IsFinished(job.Status) {
+		// Stop seeding, if it still is
+		m.client.Remove(job.ID)
+		delete(m.jobs, job.ID)
+		event.Type = EventJobRemoved
+	} else {
+		m.stopDownload(job)
+		finishedAt := time.Now()
+		job.Status = StatusCancelled
+		job.FinishedAt = &finishedAt
+	}
+	delete(m.verified, job.ID)
+
+	result := &CancelResult{Job: job.snapshot(), KeptData: keepData, Removed: []string{}}
+	if !keepData && m.sharesData(job) {
+		result.KeptData = true
+		result.Errors = append(result.Errors, "data kept as another job is for the same torrent")
+	}
+	m.saveState()
+	event.Job = result.Job
+	m.publish(event)
+	m.mu.Unlock()
+
+	if !result.KeptData {
+		// The torrent must be dropped first, or it could write the files
+		// again after they are deleted
+		m.client.waitForDrops()
+		result.Removed, result.Errors = removeJobData(result.Job, m.config.DownloadDir)
+	}
+	return result, nil
+}
+
+// sharesData reports whether another listed job is for the same torrent, and
+// so has the same files and saved .torrent file. The caller must hold mu.
+func (m *Manager) sharesData(job *Job) bool {
+	for _, other := range m.jobs {
+		if other.ID == job.ID {
+			continue
+		}
+		if job.InfoHash != "" && other.InfoHash == job.InfoHash || job.TorrentFile != "" && other.TorrentFile == job.TorrentFile {
+			return true
+		}
+	}
+	return false
+}
+
+// removeJobData deletes the job's files, whether selected or not since
+// pieces shared with a selected file may have been written to them, then
+// the directories under the download directory that are left empty and the
+// saved .torrent file, if the job has one. It returns the removed paths and
+// any failures.
+func removeJobData(job *Job, downloadDir string) ([]string, []string) {
+	removed := []string{}
+	var failures []string
+
+	dirs := make(map[string]bool)
+	for _, file := range job.Files {
+		path := filepath.FromSlash(file.Path)
+		if !filepath.IsLocal(path) {
+			// Never follow a torrent's paths out of the download directory
+			continue
+		}
+		if err := os.Remove(filepath.Join(downloadDir, path)); err == nil {
+			removed = append(removed, file.Path)
+		} else if !os.IsNotExist(err) {
+			log.Printf("Error deleting file: %v", err)
+			failures = append(failures, err.Error())
+		}
+		for dir := filepath.Dir(path); dir != "."; dir = filepath.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+
+	// Children sort after their parents, so going backwards empties each
+	// directory before it is removed
+	sorted := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Strings(sorted)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		// Fails, as it should, on directories that still hold other files
+		if err := os.Remove(filepath.Join(downloadDir, sorted[i])); err == nil {
+			removed = append(removed, filepath.ToSlash(sorted[i])+"/")
+		}
+	}
+
+	if job.TorrentFile != "" {
+		if err := os.Remove(job.TorrentFile); err == nil {
+			path := job.TorrentFile
+			if rel, err := filepath.Rel(downloadDir, path); err == nil {
+				path = rel
+			}
+			removed = append(removed, filepath.ToSlash(path))
+		} else if !os.IsNotExist(err) {
+			log.Printf("Error deleting torrent file: %v", err)
+			failures = append(failures, err.Error())
+		}
+	}
+
+	return removed, failures
+}
+
+// enqueueJob registers the job and queues it behind every job of equal or
+// higher priority, then starts as many queued jobs as the limit allows. The
+// caller must hold mu.
+func (m *Manager) enqueueJob(job *Job) {
+	m.jobs[job.ID] = job
+	job.Status = StatusQueued
+
+	position := len(m.queue)
+	for i, queuedID := range m.queue {
+		if m.jobs[queuedID].Priority < job.Priority {
+			position = i
+			break
+		}
+	}
+	m.queue = slices.Insert(m.queue, position, job.ID)
+	m.startQueuedJobs()
+}
+
+// startQueuedJobs starts jobs from the front of the queue while there are
+// free download slots. Once the Manager is closing they stay queued for the
+// next one. The caller must hold mu.
+func (m *Manager) startQueuedJobs() {
+	if m.isClosed() {
+		return
+	}
+	for len(m.queue) > 0 && (m.config.MaxActive <= 0 || len(m.downloads) < m.config.MaxActive) {
+		job := m.jobs[m.queue[0]]
+		m.queue = m.queue[1:]
+		m.startJob(job)
+	}
+	m.updateQueuePositions()
+}
+
+// updateQueuePositions numbers the queued jobs after the queue has changed
+// and publishes those that moved. The caller must hold mu.
+func (m *Manager) updateQueuePositions() {
+	for i, jobID := range m.queue {
+		job := m.jobs[jobID]
+		if job.QueuePosition != i+1 {
+			job.QueuePosition = i + 1
+			m.jobChanged(job)
+		}
+	}
+}
+
+// moveQueuedJob moves a queued job to the top or bottom of the queue, or one
+// place up or down. The caller must hold mu.
+func (m *Manager) moveQueuedJob(job *Job, to string) error {
+	index := slices.Index(m.queue, job.ID)
+	if index < 0 {
+		return ErrNotQueued
+	}
+
+	var target int
+	switch to {
+	case "top":
+		target = 0
+	case "up":
+		target = max(index-1, 0)
+	case "down":
+		target = min(index+1, len(m.queue)-1)
+	case "bottom":
+		target = len(m.queue) - 1
+	default:
+		return fmt.Errorf("invalid position %q", to)
+	}
+
+	m.queue = slices.Delete(m.queue, index, index+1)
+	m.queue = slices.Insert(m.queue, target, job.ID)
+	m.updateQueuePositions()
+	return nil
+}
+
+// startJob starts the download of a job taken off the queue in the
+// background. The caller must hold mu.
+func (m *Manager) startJob(job *Job) {
+	job.QueuePosition = 0
+	m.jobChanged(job)
+	ctx, cancel := context.WithCancel(context.Background())
+	m.downloads[job.ID] = cancel
+	m.selections[job.ID] = make(chan bool)
+
+	m.running.Add(1)
+	go func() {
+		defer m.running.Done()
+		defer cancel()
+
+		var err error
+		for attempt := 0; ; attempt++ {
+			err = m.downloadTorrent(ctx, job, attempt < m.config.Retries)
+			if ctx.Err() != nil || attempt >= m.config.Retries || !(errors.Is(err, errMetadataTimeout) || errors.Is(err, errStalled)) {
+				break
+			}
+
+			log.Printf("Retrying download (%d of %d): %v", attempt+1, m.config.Retries, err)
+			m.mu.Lock()
+			if ctx.Err() == nil {
+				m.client.Remove(job.ID)
+				job.Error = fmt.Sprintf("retry %d of %d after: %v", attempt+1, m.config.Retries, err)
+				m.jobChanged(job)
+			}
+			m.mu.Unlock()
+		}
+
+		m.mu.Lock()
+		// A cancelled or paused job has already been marked as such, and may
+		// since have been started again. Both happen under mu, so checking
+		// here cannot miss one.
+		seeding := false
+		if ctx.Err() == nil {
+			if err != nil {
+				log.Printf("Error downloading torrent: %v", err)
+				m.client.Remove(job.ID)
+			} else {
+				log.Println("Torrent downloaded successfully")
+			}
+
+			// A resumed seeding job keeps its original finish time
+			if job.FinishedAt == nil {
+				finishedAt := time.Now()
+				job.FinishedAt = &finishedAt
+			}
+			job.DownloadRate = 0
+			job.ETASeconds = 0
+			if err != nil {
+				job.Status = StatusFailed
+				job.Error = err.Error()
+			} else {
+				// The torrent stays on the client to seed
+				job.Status = StatusSeeding
+				job.Error = ""
+				seeding = true
+			}
+			delete(m.downloads, job.ID)
+			delete(m.selections, job.ID)
+			m.jobChanged(job)
+		}
+		// Hand the freed slot to the next queued job
+		m.startQueuedJobs()
+		m.saveState()
+		m.mu.Unlock()
+
+		if seeding {
+			m.seedJob(job)
+		}
+	}()
+}
+
+// stopDownload takes a job off the queue, stops its download goroutine and
+// drops its torrent so it no longer fetches or seeds. The data stays on disk.
+// The caller must hold mu.
+func (m *Manager) stopDownload(job *Job) {
+	// A queued job has no download to stop yet
+	if index := slices.Index(m.queue, job.ID); index >= 0 {
+		m.queue = slices.Delete(m.queue, index, index+1)
+		job.QueuePosition = 0
+		m.updateQueuePositions()
+	}
+
+	// Tell the download goroutine to stop. This does not wait for it, so
+	// it never blocks while mu is held.
+	if cancel, exists := m.downloads[job.ID]; exists {
+		cancel()
+	}
+
+	m.client.Remove(job.ID)
+	delete(m.downloads, job.ID)
+	delete(m.selections, job.ID)
+}
@@ -0,0 +1,450 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// testFileSize and testRateLimit keep a download running for a few seconds,
+// long enough to act on it while it transfers.
+const (
+	testFileSize  = 4 << 20
+	testRateLimit = 1 << 20
+	testTimeout   = time.Minute
+	// pauseCycles is how often TestConcurrentAccess pauses and resumes.
+	pauseCycles = 5
+)
+
+// newSeeder seeds a file of random data from a torrent client of its own and
+// returns a magnet URI that points straight at it, along with the data.
+func newSeeder(t *testing.T, name string) (string, []byte) {
+	t.Helper()
+
+	dir := t.TempDir()
+	data := make([]byte, testFileSize)
+	rand.Read(data)
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	info := metainfo.Info{PieceLength: 256 << 10}
+	if err := info.BuildFromFilePath(filepath.Join(dir, name)); err != nil {
+		t.Fatal(err)
+	}
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi := &metainfo.MetaInfo{InfoBytes: infoBytes}
+
+	config := torrent.NewDefaultClientConfig()
+	config.DataDir = dir
+	config.ListenPort = 0
+	config.Seed = true
+	config.NoDHT = true
+	config.DisableTrackers = true
+	config.NoDefaultPortForwarding = true
+	client, err := torrent.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	seeded, err := client.AddTorrent(mi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := seeded.VerifyData(); err != nil {
+		t.Fatal(err)
+	}
+
+	infoHash := mi.HashInfoBytes()
+	magnet := mi.Magnet(&infoHash, &info)
+	magnet.Params = url.Values{"x.pe": {fmt.Sprintf("127.0.0.1:%d", client.LocalPort())}}
+	return magnet.String(), data
+}
+
+// newTestManager creates a Manager that only reaches peers it is told of, so
+// the tests stay off the DHT and leave the router alone.
+func newTestManager(t *testing.T, config Config) *Manager {
+	t.Helper()
+
+	if config.DownloadDir == "" {
+		config.DownloadDir = t.TempDir()
+	}
+	config.NoDHT = true
+	config.NoPortForwarding = true
+	m, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Close)
+	return m
+}
+
+// waitForStatus reads events until the job reaches one of the statuses.
+func waitForStatus(t *testing.T, events <-chan Event, jobID JobID, statuses ...string) *Job {
+	t.Helper()
+
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatalf("events closed before job reached %v", statuses)
+			}
+			if event.Job != nil && event.Job.ID == jobID && slices.Contains(statuses, event.Job.Status) {
+				return event.Job
+			}
+		case <-timeout:
+			t.Fatalf("job did not reach %v within %s", statuses, testTimeout)
+		}
+	}
+}
+
+func TestDownload(t *testing.T) {
+	magnetURI, data := newSeeder(t, "video.mp4")
+	m := newTestManager(t, Config{})
+	ctx := t.Context()
+
+	events := m.Subscribe(ctx)
+	jobID, err := m.Add(ctx, Source{URI: magnetURI})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := waitForStatus(t, events, jobID, StatusSeeding, StatusFailed)
+	if job.Status != StatusSeeding {
+		t.Fatalf("job failed: %s", job.Error)
+	}
+	if job.Progress != 100 || job.DownloadedBytes != testFileSize {
+		t.Errorf("progress is %d%% with %d bytes, want 100%% with %d", job.Progress, job.DownloadedBytes, testFileSize)
+	}
+	got, err := os.ReadFile(filepath.Join(m.DownloadDir(), "video.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded file differs from the seeded one")
+	}
+}
+
+func TestAddDuplicate(t *testing.T) {
+	magnetURI, _ := newSeeder(t, "video.mp4")
+	m := newTestManager(t, Config{Limits: RateLimits{DownloadRateLimit: testRateLimit}})
+	ctx := t.Context()
+
+	if _, err := m.Add(ctx, Source{URI: magnetURI}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Add(ctx, Source{URI: magnetURI}); !errors.Is(err, ErrDuplicateJob) {
+		t.Fatalf("second Add returned %v, want ErrDuplicateJob", err)
+	}
+}
+
+// TestConcurrentAccess reads the jobs from several goroutines while it
+// pauses, re-limits and resumes a running download. Run it with -race.
+func TestConcurrentAccess(t *testing.T) {
+	magnetURI, data := newSeeder(t, "video.mp4")
+	m := newTestManager(t, Config{Limits: RateLimits{DownloadRateLimit: testRateLimit}})
+	ctx := t.Context()
+
+	events := m.Subscribe(ctx)
+	jobID, err := m.Add(ctx, Source{URI: magnetURI})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(t, events, jobID, StatusDownloading)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				job, err := m.Get(jobID)
+				if err != nil {
+					t.Errorf("Get: %v", err)
+					return
+				}
+				if job.Status == StatusFailed || job.Status == StatusCancelled {
+					t.Errorf("job has status %s while it is paused and resumed", job.Status)
+					return
+				}
+				if list := m.List(); len(list) != 1 || list[0].ID != jobID {
+					t.Errorf("List returned %d jobs, want only the added one", len(list))
+					return
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		subCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		updates := m.Subscribe(subCtx)
+		for {
+			select {
+			case <-stop:
+				return
+			case event := <-updates:
+				if event.Job != nil && (event.Job.Progress < 0 || event.Job.Progress > 100) {
+					t.Errorf("event reports progress %d%%", event.Job.Progress)
+				}
+			}
+		}
+	}()
+
+	for i := range pauseCycles {
+		job, err := m.Pause(jobID)
+		if err != nil {
+			t.Fatalf("Pause: %v", err)
+		}
+		if job.Status != StatusPaused {
+			t.Fatalf("paused job has status %s", job.Status)
+		}
+		waitForStatus(t, events, jobID, StatusPaused)
+
+		limits := RateLimits{DownloadRateLimit: int64(i+1) * testRateLimit}
+		if job, err = m.SetJobLimits(jobID, limits); err != nil {
+			t.Fatalf("SetJobLimits: %v", err)
+		}
+		if job.RateLimits != limits {
+			t.Fatalf("job has limits %+v, want %+v", job.RateLimits, limits)
+		}
+
+		if job, err = m.Resume(jobID); err != nil {
+			t.Fatalf("Resume: %v", err)
+		}
+		if job.Status == StatusPaused || IsFinished(job.Status) {
+			t.Fatalf("resumed job has status %s", job.Status)
+		}
+		waitForStatus(t, events, jobID, StatusDownloading, StatusSeeding)
+	}
+	close(stop)
+	wg.Wait()
+
+	job := waitForStatus(t, events, jobID, StatusSeeding, StatusFailed)
+	if job.Status != StatusSeeding {
+		t.Fatalf("job failed: %s", job.Error)
+	}
+	got, err := os.ReadFile(filepath.Join(m.DownloadDir(), "video.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded file differs from the seeded one")
+	}
+}
+
+// TestCancelWhileDownloading cancels a job while other goroutines pause it
+// and read it. Cancel must win and delete the data.
+func TestCancelWhileDownloading(t *testing.T) {
+	magnetURI, _ := newSeeder(t, "video.mp4")
+	m := newTestManager(t, Config{Limits: RateLimits{DownloadRateLimit: testRateLimit}})
+	ctx := t.Context()
+
+	events := m.Subscribe(ctx)
+	jobID, err := m.Add(ctx, Source{URI: magnetURI})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(t, events, jobID, StatusDownloading)
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := m.Pause(jobID); err != nil && !errors.Is(err, ErrNotRunning) {
+				t.Errorf("Pause: %v", err)
+			}
+			if _, err := m.Get(jobID); err != nil {
+				t.Errorf("Get: %v", err)
+			}
+			m.List()
+		}()
+	}
+	result, err := m.Cancel(jobID, false)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Job.Status != StatusCancelled {
+		t.Errorf("cancelled job has status %s", result.Job.Status)
+	}
+	if _, err := os.Stat(filepath.Join(m.DownloadDir(), "video.mp4")); !os.IsNotExist(err) {
+		t.Errorf("data of cancelled job still exists: %v", err)
+	}
+
+	// Close waits for the download goroutine to exit, so whatever it does
+	// on the way out has happened by the time the job is read
+	m.Close()
+	job, err := m.Get(jobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != StatusCancelled {
+		t.Errorf("job has status %s after cancelling, want %s", job.Status, StatusCancelled)
+	}
+}
+
+// TestCloseResumes closes a Manager mid-download and checks that the job
+// carries on in the next one rather than being marked failed.
+func TestCloseResumes(t *testing.T) {
+	magnetURI, data := newSeeder(t, "video.mp4")
+	config := Config{
+		DownloadDir: t.TempDir(),
+		Limits:      RateLimits{DownloadRateLimit: testRateLimit},
+	}
+	ctx := t.Context()
+
+	m := newTestManager(t, config)
+	events := m.Subscribe(ctx)
+	jobID, err := m.Add(ctx, Source{URI: magnetURI})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(t, events, jobID, StatusDownloading)
+	m.Close()
+	// A second Close does nothing
+	m.Close()
+
+	m = newTestManager(t, Config{DownloadDir: config.DownloadDir})
+	events = m.Subscribe(ctx)
+	job, err := m.Get(jobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsFinished(job.Status) || job.Status == StatusPaused {
+		t.Fatalf("job has status %s after a restart, want it resumed", job.Status)
+	}
+
+	// Without the rate limit it may already be done
+	if job.Status != StatusSeeding {
+		job = waitForStatus(t, events, jobID, StatusSeeding, StatusFailed)
+	}
+	if job.Status != StatusSeeding {
+		t.Fatalf("job failed: %s", job.Error)
+	}
+	got, err := os.ReadFile(filepath.Join(config.DownloadDir, "video.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded file differs from the seeded one")
+	}
+}
+
+func TestRemoveJobData(t *testing.T) {
+	tests := []struct {
+		name        string
+		files       []string // The job's files
+		torrentFile string   // Saved .torrent file, if any
+		onDisk      []string // Created before the call, relative to a parent of the download directory "dl"
+		wantRemoved []string
+		wantLeft    []string
+	}{
+		{
+			name:        "single file",
+			files:       []string{"video.mp4"},
+			onDisk:      []string{"dl/video.mp4"},
+			wantRemoved: []string{"video.mp4"},
+		},
+		{
+			name:        "nested directories left empty",
+			files:       []string{"show/season 1/e1.mkv", "show/season 1/e2.mkv", "show/info.nfo"},
+			onDisk:      []string{"dl/show/season 1/e1.mkv", "dl/show/season 1/e2.mkv", "dl/show/info.nfo"},
+			wantRemoved: []string{"show/season 1/e1.mkv", "show/season 1/e2.mkv", "show/info.nfo", "show/season 1/", "show/"},
+		},
+		{
+			name:        "directory with other files kept",
+			files:       []string{"show/e1.mkv"},
+			onDisk:      []string{"dl/show/e1.mkv", "dl/show/notes.txt"},
+			wantRemoved: []string{"show/e1.mkv"},
+			wantLeft:    []string{"dl/show/notes.txt"},
+		},
+		{
+			name:        "missing files skipped",
+			files:       []string{"video.mp4", "extra.mkv"},
+			onDisk:      []string{"dl/extra.mkv"},
+			wantRemoved: []string{"extra.mkv"},
+		},
+		{
+			name:        "paths out of the download directory ignored",
+			files:       []string{"../outside.mkv", "/outside.mkv"},
+			onDisk:      []string{"outside.mkv"},
+			wantRemoved: []string{},
+			wantLeft:    []string{"outside.mkv"},
+		},
+		{
+			name:        "saved torrent file",
+			files:       []string{"video.mp4"},
+			torrentFile: "dl/.rsd2-torrents/abc.torrent",
+			onDisk:      []string{"dl/video.mp4", "dl/.rsd2-torrents/abc.torrent"},
+			wantRemoved: []string{"video.mp4", ".rsd2-torrents/abc.torrent"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			downloadDir := filepath.Join(root, "dl")
+			if err := os.Mkdir(downloadDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			for _, path := range tt.onDisk {
+				path = filepath.Join(root, filepath.FromSlash(path))
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			job := &Job{}
+			for _, path := range tt.files {
+				job.Files = append(job.Files, JobFile{Path: path})
+			}
+			if tt.torrentFile != "" {
+				job.TorrentFile = filepath.Join(root, filepath.FromSlash(tt.torrentFile))
+			}
+
+			removed, failures := removeJobData(job, downloadDir)
+			if len(failures) > 0 {
+				t.Errorf("failures: %v", failures)
+			}
+			if !slices.Equal(removed, tt.wantRemoved) {
+				t.Errorf("removed %q, want %q", removed, tt.wantRemoved)
+			}
+			for _, path := range tt.onDisk {
+				_, err := os.Stat(filepath.Join(root, filepath.FromSlash(path)))
+				if left := slices.Contains(tt.wantLeft, path); left != (err == nil) {
+					t.Errorf("%s exists: %v, want %v", path, err == nil, left)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// scheduleCheckInterval is how often the bandwidth schedule is re-evaluated.
+	scheduleCheckInterval = 30 * time.Second
+	// defaultProfileName names the limits in force outside every scheduled profile.
+	defaultProfileName = "default"
+	// autoProfileName asks SetProfile to follow the schedule again.
+	autoProfileName = "auto"
+)
+
+// BandwidthProfile applies its rate limits on the given days between Start
+// and End, local time in "15:04" form. An End before Start runs past midnight
+// and an End equal to Start covers the whole day.
+type BandwidthProfile struct {
+	Name string `json:"name"`
+	// Days are "mon" to "sun", "weekdays" or "weekends"; none means every day.
+	Days  []string `json:"days"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+	RateLimits
+	days  [7]bool
+	start int // Minutes after midnight
+	end   int
+}
+
+// BandwidthStatus is the profile whose limits are in force.
+type BandwidthStatus struct {
+	Profile  string   `json:"profile"`
+	Override bool     `json:"override"`
+	Profiles []string `json:"profiles"`
+	RateLimits
+}
+
+var weekdays = map[string][]time.Weekday{
+	"sun":      {time.Sunday},
+	"mon":      {time.Monday},
+	"tue":      {time.Tuesday},
+	"wed":      {time.Wednesday},
+	"thu":      {time.Thursday},
+	"fri":      {time.Friday},
+	"sat":      {time.Saturday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekends": {time.Saturday, time.Sunday},
+}
+
+// LoadSchedule reads the bandwidth profiles from a JSON file of the form
+// {"profiles": [...]}. The first profile active at a given time wins.
+func LoadSchedule(path string) ([]BandwidthProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schedule: %w", err)
+	}
+
+	var config struct {
+		Profiles []BandwidthProfile `json:"profiles"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to decode schedule: %w", err)
+	}
+
+	seen := map[string]bool{defaultProfileName: true, autoProfileName: true}
+	for i := range config.Profiles {
+		profile := &config.Profiles[i]
+		if profile.Name == "" || seen[profile.Name] {
+			return nil, fmt.Errorf("profile %d: name %q is missing, reserved or used twice", i+1, profile.Name)
+		}
+		seen[profile.Name] = true
+
+		if profile.start, err = parseClock(profile.Start); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", profile.Name, err)
+		}
+		if profile.end, err = parseClock(profile.End); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", profile.Name, err)
+		}
+
+		if len(profile.Days) == 0 {
+			profile.days = [7]bool{true, true, true, true, true, true, true}
+		}
+		for _, name := range profile.Days {
+			days, exists := weekdays[strings.ToLower(name)]
+			if !exists {
+				return nil, fmt.Errorf("profile %s: unknown day %q", profile.Name, name)
+			}
+			for _, day := range days {
+				profile.days[day] = true
+			}
+		}
+	}
+
+	return config.Profiles, nil
+}
+
+// parseClock turns "15:04" into minutes after midnight.
+func parseClock(value string) (int, error) {
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	return clock.Hour()*60 + clock.Minute(), nil
+}
+
+// activeAt reports whether the profile covers the given time.
+func (p *BandwidthProfile) activeAt(now time.Time) bool {
+	minute := now.Hour()*60 + now.Minute()
+	day := now.Weekday()
+	switch {
+	case p.start == p.end:
+		return p.days[day]
+	case p.start < p.end:
+		return p.days[day] && minute >= p.start && minute < p.end
+	case minute >= p.start:
+		return p.days[day]
+	default:
+		// The part after midnight belongs to the day the profile started on
+		return p.days[(day+6)%7] && minute < p.end
+	}
+}
+
+// currentProfile picks the overriding profile if there is one, else the first
+// scheduled profile active now, else the default limits. The caller must hold mu.
+func (m *Manager) currentProfile(now time.Time) (string, RateLimits) {
+	for i := range m.config.Schedule {
+		profile := &m.config.Schedule[i]
+		if m.profileOverride == "" && profile.activeAt(now) || m.profileOverride == profile.Name {
+			return profile.Name, profile.RateLimits
+		}
+	}
+	return defaultProfileName, m.config.Limits
+}
+
+// applyBandwidthProfile switches the global rate limits when the current
+// profile changes. Limits set by hand last until then. The caller must hold mu.
+func (m *Manager) applyBandwidthProfile(now time.Time) {
+	name, limits := m.currentProfile(now)
+	if name == m.activeProfile {
+		return
+	}
+
+	m.activeProfile = name
+	m.client.SetLimits(limits)
+	log.Printf("Bandwidth profile %s: download %d B/s, upload %d B/s", name, limits.DownloadRateLimit, limits.UploadRateLimit)
+	m.bandwidthChanged()
+}
+
+// bandwidthStatus reports the profile in force. The caller must hold mu.
+func (m *Manager) bandwidthStatus() BandwidthStatus {
+	status := BandwidthStatus{
+		Profile:    m.activeProfile,
+		Override:   m.profileOverride != "",
+		Profiles:   []string{},
+		RateLimits: m.client.Limits(),
+	}
+	for _, profile := range m.config.Schedule {
+		status.Profiles = append(status.Profiles, profile.Name)
+	}
+	return status
+}
+
+// Bandwidth reports the bandwidth profile in force and the global limits.
+func (m *Manager) Bandwidth() BandwidthStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bandwidthStatus()
+}
+
+// SetProfile holds the named profile, or "default" for the limits outside
+// every profile, until changed again. "auto" goes back to following the
+// schedule.
+func (m *Manager) SetProfile(name string) (BandwidthStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if name != autoProfileName && name != defaultProfileName && !slices.ContainsFunc(m.config.Schedule, func(profile BandwidthProfile) bool {
+		return profile.Name == name
+	}) {
+		return m.bandwidthStatus(), ErrUnknownProfile
+	}
+
+	m.profileOverride = name
+	if name == autoProfileName {
+		m.profileOverride = ""
+	}
+	// Re-apply even an unchanged profile, dropping limits set by hand
+	m.activeProfile = ""
+	m.applyBandwidthProfile(time.Now())
+	return m.bandwidthStatus(), nil
+}
+
+// Limits returns the global rate limits in force.
+func (m *Manager) Limits() RateLimits {
+	return m.client.Limits()
+}
+
+// SetLimits changes the global rate limits. They hold until the bandwidth
+// profile next changes.
+func (m *Manager) SetLimits(limits RateLimits) {
+	m.client.SetLimits(limits)
+	log.Printf("Rate limits changed: download %d B/s, upload %d B/s", limits.DownloadRateLimit, limits.UploadRateLimit)
+
+	m.mu.Lock()
+	m.bandwidthChanged()
+	m.mu.Unlock()
+}
+
+// SetDefaultLimits replaces the global rate limits in force outside every
+// bandwidth profile. If no profile is in force they apply at once,
+// replacing any limits set by hand.
+func (m *Manager) SetDefaultLimits(limits RateLimits) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.config.Limits = limits
+	if m.activeProfile == defaultProfileName {
+		m.activeProfile = ""
+		m.applyBandwidthProfile(time.Now())
+	}
+}
@@ -0,0 +1,66 @@
+package engine
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// weekTime returns a local time on the week of Monday, 1 January 2024.
+func weekTime(day time.Weekday, hour, minute int) time.Time {
+	return time.Date(2024, time.January, 1+(int(day)+6)%7, hour, minute, 0, 0, time.Local)
+}
+
+func TestBandwidthProfileActiveAt(t *testing.T) {
+	tests := []struct {
+		name       string
+		days       []string
+		start, end string
+		now        time.Time
+		want       bool
+	}{
+		{"daytime", []string{"weekdays"}, "09:00", "17:00", weekTime(time.Monday, 10, 0), true},
+		{"daytime start", []string{"weekdays"}, "09:00", "17:00", weekTime(time.Monday, 9, 0), true},
+		{"daytime before start", []string{"weekdays"}, "09:00", "17:00", weekTime(time.Monday, 8, 59), false},
+		{"daytime end", []string{"weekdays"}, "09:00", "17:00", weekTime(time.Monday, 17, 0), false},
+		{"daytime other day", []string{"weekdays"}, "09:00", "17:00", weekTime(time.Saturday, 10, 0), false},
+		{"overnight before midnight", nil, "23:00", "07:00", weekTime(time.Monday, 23, 30), true},
+		{"overnight after midnight", nil, "23:00", "07:00", weekTime(time.Tuesday, 6, 59), true},
+		{"overnight end", nil, "23:00", "07:00", weekTime(time.Tuesday, 7, 0), false},
+		{"overnight midday", nil, "23:00", "07:00", weekTime(time.Tuesday, 12, 0), false},
+		{"overnight from the last weekday", []string{"weekdays"}, "22:00", "06:00", weekTime(time.Saturday, 3, 0), true},
+		{"overnight on a day off", []string{"weekdays"}, "22:00", "06:00", weekTime(time.Saturday, 23, 0), false},
+		{"overnight from a day off", []string{"weekdays"}, "22:00", "06:00", weekTime(time.Monday, 3, 0), false},
+		{"overnight from sunday", []string{"sun"}, "22:00", "06:00", weekTime(time.Monday, 3, 0), true},
+		{"overnight from saturday", []string{"sat"}, "22:00", "06:00", weekTime(time.Sunday, 5, 59), true},
+		{"whole day start", []string{"weekends"}, "00:00", "00:00", weekTime(time.Saturday, 0, 0), true},
+		{"whole day end", []string{"weekends"}, "00:00", "00:00", weekTime(time.Sunday, 23, 59), true},
+		{"whole day next day", []string{"weekends"}, "00:00", "00:00", weekTime(time.Monday, 0, 0), false},
+		{"from midnight", []string{"mon"}, "00:00", "06:00", weekTime(time.Monday, 0, 0), true},
+		{"from midnight day before", []string{"mon"}, "00:00", "06:00", weekTime(time.Sunday, 23, 59), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile := BandwidthProfile{Name: "test", Days: tt.days, Start: tt.start, End: tt.end}
+			data, err := json.Marshal(map[string][]BandwidthProfile{"profiles": {profile}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "schedule.json")
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			schedule, err := LoadSchedule(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := schedule[0].activeAt(tt.now); got != tt.want {
+				t.Errorf("%v-%v on %v: active at %s is %v, want %v", tt.start, tt.end, tt.days, tt.now.Format("Mon 15:04"), got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+const (
+	// torrentFetchTimeout bounds fetching a .torrent file by URL.
+	torrentFetchTimeout = 30 * time.Second
+	// MaxTorrentFileSize caps the size of a .torrent file.
+	MaxTorrentFileSize = 10 << 20
+	// torrentsDirName is where .torrent files are kept, under the download directory.
+	torrentsDirName = ".rsd2-torrents"
+)
+
+// nonPublicPrefixes are the ranges, besides the loopback, link-local,
+// private and multicast ones netip knows of, that a .torrent link may not
+// reach: "this network", carrier-grade NAT, IETF protocol assignments,
+// benchmarking, reserved, and NAT64, which can embed any IPv4 address.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+}
+
+// newTorrentFetchClient returns the client .torrent files are fetched by URL
+// with. Redirects to a magnet URI, which some trackers and RSS feeds use, are
+// not followed but handed back. Unless allowPrivate is set, it only connects
+// to public addresses, after DNS and on every redirect, so a link cannot
+// reach the server itself, a cloud metadata service or the local network;
+// no proxy is used then, as the proxy would make the connection instead.
+func newTorrentFetchClient(allowPrivate bool) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if !allowPrivate {
+		dialer := &net.Dialer{Timeout: torrentFetchTimeout, Control: dialPublicOnly}
+		transport.DialContext = dialer.DialContext
+		transport.Proxy = nil
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   torrentFetchTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Scheme == "magnet" {
+				return http.ErrUseLastResponse
+			}
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		},
+	}
+}
+
+// dialPublicOnly refuses connections to addresses that are not public. It
+// runs on the resolved address, so a host name cannot hide a private one.
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !isPublicAddr(addrPort.Addr()) {
+		return fmt.Errorf("%s is not a public address", addrPort.Addr())
+	}
+	return nil
+}
+
+// isPublicAddr reports whether the address is a unicast one reachable on the
+// internet.
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// resolve returns the saved .torrent file the job is added from, if the
+// source is not a plain magnet URI, and the magnet URI the job keeps for
+// display.
+func (source *Source) resolve(ctx context.Context, client *http.Client, downloadDir string) (string, string, error) {
+	switch {
+	case source.Torrent != nil:
+		return saveTorrentFile(source.Torrent, downloadDir)
+	case isTorrentURL(source.URI):
+		return fetchTorrentFile(ctx, client, source.URI, downloadDir)
+	case source.URI == "":
+		return "", "", ErrNoSource
+	default:
+		return "", source.URI, nil
+	}
+}
+
+// isTorrentURL reports whether the download source is an HTTP(S) link rather
+// than a magnet URI.
+func isTorrentURL(source string) bool {
+	u, err := url.Parse(source)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https")
+}
+
+// fetchTorrentFile downloads a .torrent file by URL and saves it like an
+// upload. If the URL redirects to a magnet URI, that is returned instead.
+func fetchTorrentFile(ctx context.Context, client *http.Client, torrentURL string, downloadDir string) (string, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, torrentURL, nil)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %w", ErrFetchTorrent, err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %w", ErrFetchTorrent, err)
+	}
+	defer resp.Body.Close()
+
+	if location := resp.Header.Get("Location"); strings.HasPrefix(location, "magnet:") {
+		return "", location, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("%w: server responded with status %d", ErrFetchTorrent, resp.StatusCode)
+	}
+	if resp.ContentLength > MaxTorrentFileSize {
+		return "", "", errors.New("torrent file is too large")
+	}
+
+	return saveTorrentFile(resp.Body, downloadDir)
+}
+
+// saveTorrentFile parses a .torrent and keeps a copy under the download
+// directory so the job can be re-added after a restart. It returns the saved
+// path and the equivalent magnet URI.
+func saveTorrentFile(upload io.Reader, downloadDir string) (string, string, error) {
+	data, err := io.ReadAll(io.LimitReader(upload, MaxTorrentFileSize+1))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read torrent file: %w", err)
+	}
+	if len(data) > MaxTorrentFileSize {
+		return "", "", errors.New("torrent file is too large")
+	}
+
+	mi, err := metainfo.Load(bytes.NewReader(data))
+	if err != nil {
+		return "", "", fmt.Errorf("invalid torrent file: %w", err)
+	}
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		return "", "", fmt.Errorf("invalid torrent file: %w", err)
+	}
+	infoHash := mi.HashInfoBytes()
+
+	dir := filepath.Join(downloadDir, torrentsDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", "", fmt.Errorf("failed to create directory: %w", err)
+	}
+	torrentFile := filepath.Join(dir, infoHash.HexString()+".torrent")
+	if err := os.WriteFile(torrentFile, data, 0644); err != nil {
+		return "", "", fmt.Errorf("failed to save torrent file: %w", err)
+	}
+
+	return torrentFile, mi.Magnet(&infoHash, &info).String(), nil
+}
@@ -0,0 +1,97 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// State is the content of the state file.
+type State struct {
+	Jobs []*Job `json:"jobs"`
+}
+
+// JobStore persists jobs to a JSON file so they survive server restarts.
+type JobStore struct {
+	path string
+}
+
+func NewJobStore(path string) *JobStore {
+	return &JobStore{path: path}
+}
+
+// Load reads the saved state. A missing state file yields an empty state.
+func (s *JobStore) Load() (*State, error) {
+	state := &State{}
+
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse state file: %w", err)
+	}
+
+	return state, nil
+}
+
+// Save replaces the state file.
+func (s *JobStore) Save(state *State) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	if err := WriteFileAtomic(s.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return nil
+}
+
+// WriteFileAtomic replaces the file at path with data. The data goes to a
+// new file with a unique name in the same directory, which is synced to disk
+// before it is renamed over path, so a crash or power loss leaves either the
+// old content or the new, and concurrent writers never share a temporary
+// file.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	// Does nothing once the rename has happened
+	defer os.Remove(tmpPath)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	// The rename is only durable once the directory is synced too
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
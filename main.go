@@ -1,149 +1,359 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
-	"github.com/anacrolix/torrent"
 	"github.com/google/uuid"
+	"github.com/omgbox/rsd2/engine"
 )
 
 var (
-	progressMap     = make(map[string]*ProgressResponse)
-	downloadMap     = make(map[string]chan bool)
-	fileMap         = make(map[string]string) // Map to store the file path for each session
-	mu              sync.Mutex
-	bufferPool      = sync.Pool{
-		New: func() interface{} {
-			return make([]byte, 1024)
-		},
-	}
-	users = map[string]string{
-		"demo": "password",
-		"downloads": "downloads",
-		// Add more users as needed
-	}
+	manager         *engine.Manager
+	fileBrowser     bool              // Whether the downloaded files are listed and served
+	usersMu         sync.Mutex        // Guards users and unknownUserHash, which SIGHUP may replace
+	users           map[string]string // User names to bcrypt or argon2id password hashes
+	unknownUserHash string            // Checked for unknown users, made like the users' own hashes
+	usersFile       string            // htpasswd-style file of users, re-read on SIGHUP
+	withDemo        bool              // Whether the well-known demo users may log in
+	loginLimiter    *loginThrottle    // Locks out addresses that fail to log in too often
 )
 
-type ProgressResponse struct {
-	Progress        int    `json:"progress"`
-	DownloadedBytes int64  `json:"downloaded_bytes"`
-	TotalSizeBytes  int64  `json:"total_size_bytes"`
-}
-
-func downloadTorrent(magnetURI string, cancelChan chan bool, progress *ProgressResponse, sessionID string, downloadDir string) error {
-	clientConfig := torrent.NewDefaultClientConfig()
-	clientConfig.DataDir = downloadDir
-	clientConfig.ListenPort = 0 // Allow the client to choose an available port
+const (
+	// eventsKeepAliveInterval is how often an idle /events stream gets a comment
+	// so proxies do not close it.
+	eventsKeepAliveInterval = 30 * time.Second
+	// filesRefreshInterval is how often /events streams re-list the download directory.
+	filesRefreshInterval = 5 * time.Second
+	// maxUploadSize caps a /download request body: a .torrent file plus room
+	// for the other form fields and the multipart headers.
+	maxUploadSize = engine.MaxTorrentFileSize + 1<<20
+	// shutdownTimeout is how long requests in progress get to finish once
+	// the server is asked to stop.
+	shutdownTimeout = 10 * time.Second
+)
 
-	client, err := torrent.NewClient(clientConfig)
+// writeJob encodes the job, or answers with the status matching the engine's
+// error.
+func writeJob(w http.ResponseWriter, job *engine.Job, err error) {
 	if err != nil {
-		return fmt.Errorf("failed to create torrent client: %w", err)
+		writeError(w, err)
+		return
 	}
-	defer client.Close()
 
-	t, err := client.AddMagnet(magnetURI)
-	if err != nil {
-		return fmt.Errorf("failed to add magnet URI: %w", err)
-	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
 
-	<-t.GotInfo()
+// writeError maps an engine error to its HTTP status: 404 for an unknown job,
+// 409 for a job in the wrong state or a torrent that is already added, 502
+// for a .torrent URL that could not be fetched, and 400 for anything else.
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, engine.ErrJobNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, engine.ErrFetchTorrent):
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	case errors.Is(err, engine.ErrNotQueued),
+		errors.Is(err, engine.ErrNotSelectingFiles),
+		errors.Is(err, engine.ErrNotRunning),
+		errors.Is(err, engine.ErrNotPaused),
+		errors.Is(err, engine.ErrNotTransferring),
+		errors.Is(err, engine.ErrDuplicateJob):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
 
-	// Calculate the total size of the torrent
-	var totalSize int64
-	for _, file := range t.Files() {
-		totalSize += file.Length()
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.URL.Query().Get("sessionID")
+	if sessionID == "" {
+		http.Error(w, "sessionID is required", http.StatusBadRequest)
+		return
 	}
-	progress.TotalSizeBytes = totalSize
 
-	// Download all files in the torrent
-	for _, file := range t.Files() {
-		err := downloadFile(file, cancelChan, progress, sessionID, downloadDir)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessionJobs(sessionID))
+}
+
+// limitsHandler reports the global rate limits on GET and changes them on
+// POST. Changes hold until the bandwidth profile next changes and are not
+// kept across restarts.
+func limitsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		limits, err := parseRateLimits(r, manager.Limits())
 		if err != nil {
-			return err
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
+		manager.SetLimits(limits)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	return nil
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(manager.Limits())
 }
 
-func downloadFile(file *torrent.File, cancelChan chan bool, progress *ProgressResponse, sessionID string, downloadDir string) error {
-	filePath := filepath.Join(downloadDir, file.Path())
-	fileMap[sessionID] = filePath
+// bandwidthHandler reports the bandwidth profile on GET. On POST the form
+// value "profile" names a profile, or "default", to hold until changed again,
+// or is "auto" to go back to following the schedule.
+func bandwidthHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if _, err := manager.SetProfile(r.FormValue("profile")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	// Ensure the directory exists
-	dir := filepath.Dir(filePath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(manager.Bandwidth())
+}
+
+// parseRateLimits reads the download_rate_limit and upload_rate_limit form
+// values, in bytes per second, keeping the current limit for any not given.
+func parseRateLimits(r *http.Request, current engine.RateLimits) (engine.RateLimits, error) {
+	limits := current
+	for name, limit := range map[string]*int64{
+		"download_rate_limit": &limits.DownloadRateLimit,
+		"upload_rate_limit":   &limits.UploadRateLimit,
+	} {
+		value := r.FormValue(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			return current, fmt.Errorf("invalid %s", name)
+		}
+		*limit = parsed
 	}
+	return limits, nil
+}
 
-	outFile, err := os.Create(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+// sessionJobs lists the session's jobs, oldest first.
+func sessionJobs(sessionID string) []*engine.Job {
+	owned := []*engine.Job{}
+	for _, job := range manager.List() {
+		if job.SessionID == sessionID {
+			owned = append(owned, job)
+		}
 	}
-	defer outFile.Close()
+	return owned
+}
 
-	reader := file.NewReader()
-	defer reader.Close()
+// eventsHandler streams the session's jobs as Server-Sent Events. A "jobs"
+// event carrying the full list is sent whenever any of them changes, and a
+// "bandwidth" event whenever the bandwidth profile or global limits do. With
+// the file browser on, a "files" event is sent whenever the downloaded video
+// files change.
+func eventsHandler(w http.ResponseWriter, r *http.Request, downloadDir string) {
+	sessionID := r.URL.Query().Get("sessionID")
+	if sessionID == "" {
+		http.Error(w, "sessionID is required", http.StatusBadRequest)
+		return
+	}
 
-	buffer := bufferPool.Get().([]byte)
-	defer bufferPool.Put(buffer)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	events := manager.Subscribe(r.Context())
+
+	keepAlive := time.NewTicker(eventsKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	var filesRefresh <-chan time.Time
+	var lastFiles []byte
+	sendFiles := func() {
+		videoFiles, err := listVideoFiles(downloadDir)
+		if err != nil {
+			log.Printf("Error listing files: %v", err)
+			return
+		}
+		data, _ := json.Marshal(videoFiles)
+		if !bytes.Equal(data, lastFiles) {
+			fmt.Fprintf(w, "event: files\ndata: %s\n\n", data)
+			flusher.Flush()
+			lastFiles = data
+		}
+	}
+	if fileBrowser {
+		ticker := time.NewTicker(filesRefreshInterval)
+		defer ticker.Stop()
+		filesRefresh = ticker.C
+		sendFiles()
+	}
 
+	var lastJobs, lastBandwidth []byte
 	for {
+		data, err := json.Marshal(sessionJobs(sessionID))
+		if err != nil {
+			log.Printf("Error encoding jobs: %v", err)
+			return
+		}
+		bandwidth, _ := json.Marshal(manager.Bandwidth())
+		if !bytes.Equal(data, lastJobs) {
+			fmt.Fprintf(w, "event: jobs\ndata: %s\n\n", data)
+			flusher.Flush()
+			lastJobs = data
+		}
+		if !bytes.Equal(bandwidth, lastBandwidth) {
+			fmt.Fprintf(w, "event: bandwidth\ndata: %s\n\n", bandwidth)
+			flusher.Flush()
+			lastBandwidth = bandwidth
+		}
+
 		select {
-		case <-cancelChan:
-			// Delete the file when canceled
-			if err := os.Remove(filePath); err != nil {
-				log.Printf("Error deleting file: %v", err)
-			}
-			return nil
-		default:
-			n, err := reader.Read(buffer)
-			if n > 0 {
-				progress.DownloadedBytes += int64(n)
-				progress.Progress = int(float64(progress.DownloadedBytes) / float64(progress.TotalSizeBytes) * 100)
-				_, err := outFile.Write(buffer[:n])
-				if err != nil {
-					return fmt.Errorf("failed to write to file: %w", err)
-				}
-			}
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				return fmt.Errorf("failed to read from torrent file: %w", err)
+		case _, ok := <-events:
+			if !ok {
+				return
 			}
+		case <-filesRefresh:
+			sendFiles()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
 		}
 	}
-
-	return nil
 }
 
-func progressHandler(w http.ResponseWriter, r *http.Request) {
+func jobHandler(w http.ResponseWriter, r *http.Request) {
 	sessionID := r.URL.Query().Get("sessionID")
 	if sessionID == "" {
 		http.Error(w, "sessionID is required", http.StatusBadRequest)
 		return
 	}
+	jobID, action, _ := strings.Cut(r.URL.Path[len("/jobs/"):], "/")
 
-	mu.Lock()
-	defer mu.Unlock()
-
-	progress, exists := progressMap[sessionID]
-	if !exists {
-		http.Error(w, "session not found", http.StatusNotFound)
+	job, err := manager.Get(engine.JobID(jobID))
+	if err != nil || job.SessionID != sessionID {
+		http.Error(w, "job not found", http.StatusNotFound)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(progress)
+	switch action {
+	case "":
+		switch r.Method {
+		case http.MethodGet:
+			writeJob(w, job, nil)
+		case http.MethodDelete:
+			keepData := engine.IsFinished(job.Status) && job.Status != engine.StatusFailed
+			if value := r.FormValue("keep_data"); value != "" {
+				if keepData, err = strconv.ParseBool(value); err != nil {
+					http.Error(w, "invalid keep_data", http.StatusBadRequest)
+					return
+				}
+			}
+			result, err := manager.Cancel(job.ID, keepData)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(result)
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	case "files":
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		selectJobFiles(w, r, job)
+	case "move":
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		job, err = manager.Move(job.ID, r.FormValue("to"))
+		writeJob(w, job, err)
+	case "limits":
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		limits, err := parseRateLimits(r, job.RateLimits)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		job, err = manager.SetJobLimits(job.ID, limits)
+		writeJob(w, job, err)
+	case "pause":
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		job, err = manager.Pause(job.ID)
+		writeJob(w, job, err)
+	case "resume":
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		job, err = manager.Resume(job.ID)
+		writeJob(w, job, err)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// selectJobFiles applies the "file" indices posted for a job that is waiting
+// on a file selection and lets its download start.
+func selectJobFiles(w http.ResponseWriter, r *http.Request, job *engine.Job) {
+	r.ParseForm()
+	var indices []int
+	for _, value := range r.Form["file"] {
+		index, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "invalid file index", http.StatusBadRequest)
+			return
+		}
+		indices = append(indices, index)
+	}
+
+	job, err := manager.SelectFiles(job.ID, indices)
+	writeJob(w, job, err)
 }
 
 func indexHandler(w http.ResponseWriter, r *http.Request) {
@@ -151,275 +361,888 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 
 	html := `
 	<!DOCTYPE html>
-	<html>
+	<html lang="en">
 	<head>
-		<title>Torrent Downloader</title>
 		<meta charset="UTF-8">
 		<meta name="viewport" content="width=device-width, initial-scale=1.0">
+		<title>Torrent Downloader</title>
+		<link href="https://cdn.jsdelivr.net/npm/tailwindcss@2.2.19/dist/tailwind.min.css" rel="stylesheet">
+		<link href="https://cdnjs.cloudflare.com/ajax/libs/flowbite/1.0.0/flowbite.min.css" rel="stylesheet">
 		<style>
-			body {
-				display: flex;
-				justify-content: center;
-				align-items: center;
-				height: 100vh;
-				font-family: Arial, sans-serif;
-				background-color: #f0f0f0;
-				margin: 0;
-			}
-			.container {
-				text-align: center;
-				background-color: #fff;
-				padding: 20px;
-				border-radius: 10px;
-				box-shadow: 0 0 10px rgba(0, 0, 0, 0.1);
-			}
-			input[type="text"] {
-				width: 100%;
-				padding: 10px;
-				margin-bottom: 10px;
-				border: 1px solid #ccc;
-				border-radius: 5px;
-			}
-			button {
-				padding: 10px 20px;
-				background-color: #007bff;
-				color: #fff;
-				border: none;
-				border-radius: 5px;
-				cursor: pointer;
-				margin-top: 10px;
-			}
-			button:hover {
-				background-color: #0056b3;
-			}
-			progress {
-				width: 100%;
-				height: 20px;
-				margin-top: 20px;
-			}
-			#cancelBtn {
+			.hidden {
 				display: none;
-				margin-top: 10px;
-			}
-			.error-message {
-				color: red;
-				margin-top: 10px;
 			}
 		</style>
 		<script>
-			var sessionID = "` + uuid.New().String() + `";
-			var cancelDownload = null;
+			// Keep the session across reloads so its jobs stay listed
+			var sessionID = localStorage.getItem("sessionID") || "` + uuid.New().String() + `";
+			localStorage.setItem("sessionID", sessionID);
+			// Checkbox state survives the periodic re-render of the job list
+			var fileSelections = {};
+			// Set by the server's -file-browser flag
+			var fileBrowser = ` + strconv.FormatBool(fileBrowser) + `;
 
 			function formatBytes(bytes) {
 				return (bytes / (1024 * 1024)).toFixed(2) + " MB";
 			}
 
-			function updateProgress() {
+			function formatDuration(seconds) {
+				var hours = Math.floor(seconds / 3600);
+				var minutes = Math.floor(seconds / 60) - hours * 60;
+				return (hours > 0 ? hours + "h " : "") + minutes + "m " + (seconds - hours * 3600 - minutes * 60) + "s";
+			}
+
+			function isFinished(status) {
+				return ["seeding", "completed", "cancelled", "failed"].indexOf(status) >= 0;
+			}
+
+			function renderJobs(jobs) {
+				var jobList = document.getElementById("jobList");
+				jobList.innerHTML = "";
+				jobs.forEach(function(job) {
+					var item = document.createElement("div");
+					item.className = "border-b border-gray-200 py-4";
+
+					var name = document.createElement("p");
+					name.className = "text-sm text-gray-700 break-all mb-2";
+					name.innerText = job.name || job.magnet_uri;
+					item.appendChild(name);
+
+					var progressBar = document.createElement("progress");
+					progressBar.className = "w-full h-4 mb-2";
+					progressBar.max = 100;
+					progressBar.value = job.progress;
+					item.appendChild(progressBar);
+
+					var size = document.createElement("p");
+					size.innerText = "Downloaded: " + formatBytes(job.downloaded_bytes) + " of " + formatBytes(job.total_size_bytes);
+					item.appendChild(size);
+
+					if (job.status == "downloading" || job.status == "stalled") {
+						var transfer = document.createElement("p");
+						transfer.innerText = "Speed: " + formatBytes(job.download_rate) + "/s down, " + formatBytes(job.upload_rate) + "/s up" +
+							" | ETA: " + (job.eta_seconds >= 0 ? formatDuration(job.eta_seconds) : "unknown");
+						item.appendChild(transfer);
+
+						var peers = document.createElement("p");
+						peers.innerText = "Peers: " + job.peers + " connected of " + job.total_peers + " known, " + job.seeders + " seeders" +
+							" | Availability: " + job.availability.toFixed(1) + "%";
+						item.appendChild(peers);
+					}
+
+					if (job.status == "seeding" || job.status == "completed") {
+						var seeding = document.createElement("p");
+						seeding.className = "text-sm text-gray-700";
+						seeding.innerText = "Ratio: " + job.ratio.toFixed(2) + " (" + formatBytes(job.uploaded_bytes) + " uploaded) | Seeded for: " + formatDuration(job.seeding_seconds);
+						if (job.status == "seeding") {
+							seeding.innerText += " | Upload: " + formatBytes(job.upload_rate) + "/s to " + job.peers + " peers";
+						}
+						item.appendChild(seeding);
+					}
+
+					if (job.download_rate_limit || job.upload_rate_limit) {
+						var jobLimits = document.createElement("p");
+						jobLimits.className = "text-sm text-gray-700";
+						jobLimits.innerText = "Limits: " + formatRateLimit(job.download_rate_limit) + " down, " + formatRateLimit(job.upload_rate_limit) + " up";
+						item.appendChild(jobLimits);
+					}
+
+					var status = document.createElement("p");
+					status.innerText = "Status: " + job.status.replace("_", " ");
+					if (job.queue_position) {
+						status.innerText += " (#" + job.queue_position + ")";
+					}
+					item.appendChild(status);
+
+					if (job.error) {
+						var error = document.createElement("p");
+						error.className = "text-red-500";
+						error.innerText = job.error;
+						item.appendChild(error);
+					}
+
+					if (job.status == "selecting_files") {
+						item.appendChild(renderFileSelection(job));
+					}
+
+					if (job.status == "queued") {
+						[["top", "Move to top"], ["up", "Up"], ["down", "Down"]].forEach(function(move) {
+							var moveBtn = document.createElement("button");
+							moveBtn.innerText = move[1];
+							moveBtn.className = "bg-gray-500 text-white px-4 py-2 rounded mt-2 mr-2";
+							moveBtn.onclick = function() {
+								moveJob(job.id, move[0]);
+							};
+							item.appendChild(moveBtn);
+						});
+					}
+
+					if (job.status == "paused") {
+						var resumeBtn = document.createElement("button");
+						resumeBtn.className = "bg-gray-500 text-white px-4 py-2 rounded mt-2 mr-2";
+						resumeBtn.innerText = "Resume";
+						resumeBtn.onclick = function() {
+							controlJob(job.id, "resume");
+						};
+						item.appendChild(resumeBtn);
+					} else if (!isFinished(job.status) || job.status == "seeding") {
+						var pauseBtn = document.createElement("button");
+						pauseBtn.className = "bg-gray-500 text-white px-4 py-2 rounded mt-2 mr-2";
+						pauseBtn.innerText = "Pause";
+						pauseBtn.onclick = function() {
+							controlJob(job.id, "pause");
+						};
+						item.appendChild(pauseBtn);
+					}
+
+					if (!isFinished(job.status) || job.status == "seeding") {
+						var limitBtn = document.createElement("button");
+						limitBtn.innerText = "Limit";
+						limitBtn.className = "bg-gray-500 text-white px-4 py-2 rounded mt-2 mr-2";
+						limitBtn.onclick = function() {
+							setJobLimits(job);
+						};
+						item.appendChild(limitBtn);
+					}
+
+					if (!isFinished(job.status)) {
+						var keepBtn = document.createElement("button");
+						keepBtn.className = "bg-gray-500 text-white px-4 py-2 rounded mt-2 mr-2";
+						keepBtn.innerText = "Cancel, keep data";
+						keepBtn.onclick = function() {
+							cancelJob(job.id, true);
+						};
+						item.appendChild(keepBtn);
+					}
+
+					var cancelBtn = document.createElement("button");
+					cancelBtn.className = "bg-red-500 text-white px-4 py-2 rounded mt-2";
+					cancelBtn.innerText = isFinished(job.status) ? "Dismiss" : "Cancel";
+					cancelBtn.onclick = function() {
+						cancelJob(job.id);
+					};
+					item.appendChild(cancelBtn);
+
+					jobList.appendChild(item);
+				});
+				document.getElementById("noJobs").style.display = jobs.length > 0 ? "none" : "block";
+			}
+
+			function renderFileSelection(job) {
+				if (!(job.id in fileSelections)) {
+					fileSelections[job.id] = job.files.map(function(file) {
+						return file.selected;
+					});
+				}
+				var selection = fileSelections[job.id];
+
+				var container = document.createElement("div");
+				container.className = "my-2 text-left";
+				job.files.forEach(function(file, index) {
+					var label = document.createElement("label");
+					label.className = "block text-sm text-gray-700 break-all";
+					var checkbox = document.createElement("input");
+					checkbox.type = "checkbox";
+					checkbox.checked = selection[index];
+					checkbox.onchange = function() {
+						selection[index] = checkbox.checked;
+					};
+					label.appendChild(checkbox);
+					label.appendChild(document.createTextNode(" " + file.path + " (" + formatBytes(file.length) + ")"));
+					container.appendChild(label);
+				});
+
+				var selectBtn = document.createElement("button");
+				selectBtn.className = "bg-blue-500 text-white px-4 py-2 rounded mt-2";
+				selectBtn.innerText = "Download Selected";
+				selectBtn.onclick = function() {
+					selectFiles(job.id);
+				};
+				container.appendChild(selectBtn);
+				return container;
+			}
+
+			function selectFiles(jobID) {
+				var params = [];
+				fileSelections[jobID].forEach(function(selected, index) {
+					if (selected) {
+						params.push("file=" + index);
+					}
+				});
+
 				var xhr = new XMLHttpRequest();
-				xhr.open("GET", "/progress?sessionID=" + sessionID, true);
+				xhr.open("POST", "/jobs/" + jobID + "/files?sessionID=" + sessionID, true);
+				xhr.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
 				xhr.onreadystatechange = function() {
-					if (xhr.readyState == 4 && xhr.status == 200) {
-						var response = JSON.parse(xhr.responseText);
-						document.getElementById("progressBar").value = response.progress;
-						document.getElementById("downloaded").innerText = formatBytes(response.downloaded_bytes);
-						document.getElementById("totalSize").innerText = formatBytes(response.total_size_bytes);
-						if (response.progress < 100 && cancelDownload !== null) {
-							setTimeout(updateProgress, 100);
+					if (xhr.readyState == 4) {
+						if (xhr.status == 200) {
+							delete fileSelections[jobID];
 						} else {
-							document.getElementById("downloadBtn").style.display = "inline";
-							document.getElementById("cancelBtn").style.display = "none";
-							cancelDownload = null;
+							document.getElementById("errorMessage").innerText = "Error selecting files: " + xhr.responseText;
 						}
 					}
 				};
-				xhr.send();
+				xhr.send(params.join("&"));
+			}
+
+			function connectEvents() {
+				// EventSource reconnects by itself if the stream drops
+				var events = new EventSource("/events?sessionID=" + sessionID);
+				events.addEventListener("jobs", function(event) {
+					renderJobs(JSON.parse(event.data));
+				});
+				events.addEventListener("bandwidth", function(event) {
+					renderBandwidth(JSON.parse(event.data));
+				});
+				events.addEventListener("files", function(event) {
+					renderFiles(JSON.parse(event.data));
+				});
 			}
 
 			function startDownload() {
-				// Reset the progress bar and related elements
-				document.getElementById("progressBar").value = 0;
-				document.getElementById("downloaded").innerText = "0 MB";
-				document.getElementById("totalSize").innerText = "0 MB";
 				document.getElementById("errorMessage").innerText = "";
 
 				var magnetURI = document.getElementById("urlInput").value;
+				var torrentInput = document.getElementById("torrentInput");
+				var chooseFiles = document.getElementById("selectFilesInput").checked;
 				var xhr = new XMLHttpRequest();
 				xhr.open("POST", "/download?sessionID=" + sessionID, true);
-				xhr.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
 				xhr.onreadystatechange = function() {
 					if (xhr.readyState == 4) {
 						if (xhr.status == 200) {
-							document.getElementById("downloadBtn").style.display = "none";
-							document.getElementById("cancelBtn").style.display = "inline";
-							cancelDownload = function() {
-								var cancelXhr = new XMLHttpRequest();
-								cancelXhr.open("POST", "/cancel?sessionID=" + sessionID, true);
-								cancelXhr.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
-								cancelXhr.onreadystatechange = function() {
-									if (cancelXhr.readyState == 4 && cancelXhr.status == 200) {
-										document.getElementById("downloadBtn").style.display = "inline";
-										document.getElementById("cancelBtn").style.display = "none";
-										cancelDownload = null;
-										updateProgress();
-									}
-								};
-								cancelXhr.send();
-							};
-							updateProgress();
+							document.getElementById("urlInput").value = "";
+							torrentInput.value = "";
 						} else {
 							document.getElementById("errorMessage").innerText = "Error downloading torrent: " + xhr.responseText;
 						}
 					}
 				};
-				xhr.send("magnetURI=" + encodeURIComponent(magnetURI));
+				if (torrentInput.files.length > 0) {
+					var formData = new FormData();
+					formData.append("torrentFile", torrentInput.files[0]);
+					formData.append("selectFiles", chooseFiles);
+					xhr.send(formData);
+				} else {
+					xhr.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
+					xhr.send("magnetURI=" + encodeURIComponent(magnetURI) + "&selectFiles=" + chooseFiles);
+				}
 			}
 
-			function cancelDownloadFunc() {
-				if (cancelDownload !== null) {
-					cancelDownload();
-					// Reset the progress bar and related elements
-					document.getElementById("progressBar").value = 0;
-					document.getElementById("downloaded").innerText = "0 MB";
-					document.getElementById("totalSize").innerText = "0 MB";
-					document.getElementById("errorMessage").innerText = "";
+			function formatRateLimit(bytesPerSecond) {
+				return bytesPerSecond ? formatBytes(bytesPerSecond) + "/s" : "unlimited";
+			}
+
+			// rateLimitParams turns KB/s inputs into the API's bytes per second
+			function rateLimitParams(download, upload) {
+				var params = [];
+				if (download !== null && download !== "") {
+					params.push("download_rate_limit=" + Math.round(parseFloat(download) * 1024));
+				}
+				if (upload !== null && upload !== "") {
+					params.push("upload_rate_limit=" + Math.round(parseFloat(upload) * 1024));
+				}
+				return params.join("&");
+			}
+
+			function setJobLimits(job) {
+				var download = prompt("Download limit in KB/s (0 for none):", job.download_rate_limit / 1024);
+				if (download === null) {
+					return;
+				}
+				var upload = prompt("Upload limit in KB/s (0 for none):", job.upload_rate_limit / 1024);
+				if (upload === null) {
+					return;
+				}
+
+				var xhr = new XMLHttpRequest();
+				xhr.open("POST", "/jobs/" + job.id + "/limits?sessionID=" + sessionID, true);
+				xhr.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
+				xhr.onreadystatechange = function() {
+					if (xhr.readyState == 4) {
+						if (xhr.status != 200) {
+							document.getElementById("errorMessage").innerText = "Error setting limits: " + xhr.responseText;
+						}
+					}
+				};
+				xhr.send(rateLimitParams(download, upload));
+			}
+
+			function showLimits(limits) {
+				document.getElementById("downloadLimitInput").value = limits.download_rate_limit / 1024;
+				document.getElementById("uploadLimitInput").value = limits.upload_rate_limit / 1024;
+			}
+
+			function renderBandwidth(status) {
+				showLimits(status);
+				document.getElementById("profileInfo").style.display = status.profiles.length > 0 ? "block" : "none";
+
+				var select = document.getElementById("profileSelect");
+				select.innerHTML = "";
+				["auto"].concat(status.profiles, ["default"]).forEach(function(name) {
+					var option = document.createElement("option");
+					option.value = name;
+					option.innerText = name == "auto" ? "Follow schedule (" + status.profile + ")" : name;
+					select.appendChild(option);
+				});
+				select.value = status.override ? status.profile : "auto";
+			}
+
+			function setProfile(profile) {
+				var xhr = new XMLHttpRequest();
+				xhr.open("POST", "/bandwidth", true);
+				xhr.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
+				xhr.onreadystatechange = function() {
+					if (xhr.readyState == 4) {
+						if (xhr.status != 200) {
+							document.getElementById("errorMessage").innerText = "Error changing profile: " + xhr.responseText;
+						}
+					}
+				};
+				xhr.send("profile=" + encodeURIComponent(profile));
+			}
+
+			function setLimits() {
+				var xhr = new XMLHttpRequest();
+				xhr.open("POST", "/limits", true);
+				xhr.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
+				xhr.onreadystatechange = function() {
+					if (xhr.readyState == 4) {
+						if (xhr.status == 200) {
+							showLimits(JSON.parse(xhr.responseText));
+						} else {
+							document.getElementById("errorMessage").innerText = "Error setting limits: " + xhr.responseText;
+						}
+					}
+				};
+				xhr.send(rateLimitParams(document.getElementById("downloadLimitInput").value, document.getElementById("uploadLimitInput").value));
+			}
+
+			function moveJob(jobID, to) {
+				var xhr = new XMLHttpRequest();
+				xhr.open("POST", "/jobs/" + jobID + "/move?sessionID=" + sessionID, true);
+				xhr.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
+				xhr.onreadystatechange = function() {
+					if (xhr.readyState == 4) {
+						if (xhr.status != 200) {
+							document.getElementById("errorMessage").innerText = "Error moving download: " + xhr.responseText;
+						}
+					}
+				};
+				xhr.send("to=" + to);
+			}
+
+			// controlJob pauses or resumes a job
+			function controlJob(jobID, action) {
+				var xhr = new XMLHttpRequest();
+				xhr.open("POST", "/jobs/" + jobID + "/" + action + "?sessionID=" + sessionID, true);
+				xhr.onreadystatechange = function() {
+					if (xhr.readyState == 4) {
+						if (xhr.status != 200) {
+							document.getElementById("errorMessage").innerText = "Error trying to " + action + " download: " + xhr.responseText;
+						}
+					}
+				};
+				xhr.send();
+			}
+
+			function cancelJob(jobID, keepData) {
+				var xhr = new XMLHttpRequest();
+				xhr.open("DELETE", "/jobs/" + jobID + "?sessionID=" + sessionID + (keepData ? "&keep_data=true" : ""), true);
+				xhr.onreadystatechange = function() {
+					if (xhr.readyState == 4) {
+						if (xhr.status != 200) {
+							document.getElementById("errorMessage").innerText = "Error cancelling download: " + xhr.responseText;
+						}
+					}
+				};
+				xhr.send();
+			}
+
+			function renderFiles(response) {
+				var filesContainer = document.getElementById("filesContainer");
+				filesContainer.innerHTML = ` + "`" + `
+					<div class="relative overflow-x-auto shadow-md sm:rounded-lg">
+						<table class="w-full text-sm text-left rtl:text-right text-gray-500 dark:text-gray-400">
+							<thead class="text-xs text-gray-700 uppercase bg-gray-50 dark:bg-gray-700 dark:text-gray-400">
+								<tr>
+									<th scope="col" class="px-6 py-3">
+										File Name
+									</th>
+									<th scope="col" class="px-6 py-3">
+										Action
+									</th>
+								</tr>
+							</thead>
+							<tbody id="fileRows"></tbody>
+						</table>
+					</div>
+				` + "`" + `;
+
+				var rows = document.getElementById("fileRows");
+				response.forEach(function(file) {
+					var row = document.createElement("tr");
+					row.className = "bg-white border-b dark:bg-gray-800 dark:border-gray-700";
+
+					var name = document.createElement("th");
+					name.scope = "row";
+					name.className = "px-6 py-4 font-medium text-gray-900 whitespace-nowrap dark:text-white";
+					name.innerText = file;
+					row.appendChild(name);
+
+					var action = document.createElement("td");
+					action.className = "px-6 py-4";
+					var link = document.createElement("a");
+					link.href = "/download/" + file.split("/").map(encodeURIComponent).join("/");
+					link.className = "font-medium text-blue-600 dark:text-blue-500 hover:underline";
+					link.innerText = "Download";
+					action.appendChild(link);
+					row.appendChild(action);
+
+					rows.appendChild(row);
+				});
+			}
+
+			function toggleFiles() {
+				var filesContainer = document.getElementById("filesContainer");
+				if (filesContainer.classList.contains("hidden")) {
+					filesContainer.classList.remove("hidden");
+				} else {
+					filesContainer.classList.add("hidden");
 				}
 			}
 
 			window.onload = function() {
-				updateProgress();
+				if (!fileBrowser) {
+					document.getElementById("toggleFilesBtn").parentNode.classList.add("hidden");
+				}
+				connectEvents();
 			};
 		</script>
 	</head>
-	<body>
-		<div class="container">
-			<h1>Torrent Downloader</h1>
-			<input type="text" id="urlInput" placeholder="Enter Magnet URI to download">
-			<button id="downloadBtn" onclick="startDownload()">Download</button>
-			<button id="cancelBtn" onclick="cancelDownloadFunc()">Cancel</button>
-			<h2>Download Progress</h2>
-			<progress id="progressBar" value="0" max="100"></progress>
-			<p>Downloaded: <span id="downloaded">0 MB</span></p>
-			<p>Total Size: <span id="totalSize">0 MB</span></p>
-			<p id="errorMessage" class="error-message"></p>
+	<body class="flex justify-center items-center h-screen bg-gray-100 p-8">
+		<div class="container bg-white p-8 rounded-lg shadow-lg relative">
+			<h1 class="text-3xl font-bold mb-6">Torrent Downloader</h1>
+			<input type="text" id="urlInput" placeholder="Enter Magnet URI or .torrent URL to download" class="w-full p-2 mb-4 border border-gray-300 rounded">
+			<label class="block mb-4 text-gray-700">Or upload a .torrent file: <input type="file" id="torrentInput" accept=".torrent,application/x-bittorrent"></label>
+			<div class="flex justify-between items-center mb-6">
+				<label class="text-gray-700"><input type="checkbox" id="selectFilesInput"> Choose files before downloading</label>
+				<button id="downloadBtn" onclick="startDownload()" class="bg-blue-500 text-white px-4 py-2 rounded">Download</button>
+			</div>
+			<p id="profileInfo" class="mb-2 text-gray-700" style="display: none">Bandwidth profile: <select id="profileSelect" onchange="setProfile(this.value)" class="p-1 border border-gray-300 rounded"></select></p>
+			<p class="mb-4 text-gray-700">Max download <input type="number" id="downloadLimitInput" min="0" class="w-24 p-1 border border-gray-300 rounded"> KB/s, max upload <input type="number" id="uploadLimitInput" min="0" class="w-24 p-1 border border-gray-300 rounded"> KB/s (0 for no limit) <button onclick="setLimits()" class="bg-blue-500 text-white px-2 py-1 rounded">Apply</button></p>
+			<div class="flex justify-end mt-4 mb-4">
+				<button id="toggleFilesBtn" onclick="toggleFiles()" class="bg-blue-500 text-white px-4 py-2 rounded">Show Files</button>
+			</div>
+			<div id="progressTab" class="p-4 border border-t-0 rounded-b-lg">
+				<h2 class="text-2xl font-bold mb-4">Downloads</h2>
+				<p id="errorMessage" class="text-red-500"></p>
+				<p id="noJobs" class="text-gray-500">No downloads yet</p>
+				<div id="jobList"></div>
+			</div>
+			<div id="filesContainer" class="hidden p-4 border border-t-0 rounded-b-lg mt-4">
+				<div class="relative overflow-x-auto shadow-md sm:rounded-lg">
+					<table class="w-full text-sm text-left rtl:text-right text-gray-500 dark:text-gray-400">
+						<thead class="text-xs text-gray-700 uppercase bg-gray-50 dark:bg-gray-700 dark:text-gray-400">
+							<tr>
+								<th scope="col" class="px-6 py-3">
+									File Name
+								</th>
+								<th scope="col" class="px-6 py-3">
+									Action
+								</th>
+							</tr>
+						</thead>
+						<tbody>
+							<!-- Files will be populated here -->
+						</tbody>
+					</table>
+				</div>
+			</div>
 		</div>
 	</body>
 	</html>
 	`
-	fmt.Fprintf(w, html)
+	fmt.Fprint(w, html)
 }
 
-func downloadHandler(w http.ResponseWriter, r *http.Request, downloadDir string) {
-	r.ParseForm()
+func downloadHandler(w http.ResponseWriter, r *http.Request) {
+	// Checked as the body is read, so an oversized upload is never spooled
+	// to disk
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	var tooLarge *http.MaxBytesError
+	if err := r.ParseForm(); errors.As(err, &tooLarge) {
+		http.Error(w, "request is too large", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
 	sessionID := r.URL.Query().Get("sessionID")
 	if sessionID == "" {
 		http.Error(w, "sessionID is required", http.StatusBadRequest)
 		return
 	}
 
-	magnetURI := r.FormValue("magnetURI")
+	source := engine.Source{URI: r.FormValue("magnetURI")}
+	upload, _, err := r.FormFile("torrentFile")
+	switch {
+	case err == nil:
+		defer upload.Close()
+		source.Torrent = upload
+	case errors.As(err, &tooLarge):
+		http.Error(w, "upload is too large", http.StatusRequestEntityTooLarge)
+		return
+	case !errors.Is(err, http.ErrMissingFile) && !errors.Is(err, http.ErrNotMultipart):
+		http.Error(w, "failed to read upload", http.StatusBadRequest)
+		return
+	}
 
-	mu.Lock()
-	defer mu.Unlock()
+	if value := r.FormValue("priority"); value != "" {
+		source.Priority, err = strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "invalid priority", http.StatusBadRequest)
+			return
+		}
+	}
 
-	if _, exists := progressMap[sessionID]; exists {
-		// Reset the state if a download is already in progress
-		delete(progressMap, sessionID)
-		delete(downloadMap, sessionID)
-		delete(fileMap, sessionID)
+	source.RateLimits, err = parseRateLimits(r, engine.RateLimits{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+	source.SessionID = sessionID
+	source.SelectFiles = r.FormValue("selectFiles") == "true"
 
-	progress := &ProgressResponse{
-		Progress:        0,
-		DownloadedBytes: 0,
-		TotalSizeBytes:  0,
+	jobID, err := manager.Add(r.Context(), source)
+	if err != nil {
+		writeError(w, err)
+		return
 	}
-	progressMap[sessionID] = progress
-	cancelChan := make(chan bool)
-	downloadMap[sessionID] = cancelChan
+	job, err := manager.Get(jobID)
+	writeJob(w, job, err)
+}
 
-	go func() {
-		err := downloadTorrent(magnetURI, cancelChan, progress, sessionID, downloadDir)
-		if err != nil {
-			log.Printf("Error downloading torrent: %v", err)
-		} else {
-			log.Println("Torrent downloaded successfully")
+// completedHandler lists the selected files of every finished download,
+// relative to the download directory, by job ID.
+func completedHandler(w http.ResponseWriter, r *http.Request) {
+	completed := make(map[engine.JobID][]string)
+	for _, job := range manager.List() {
+		if job.Status != engine.StatusSeeding && job.Status != engine.StatusCompleted {
+			continue
 		}
+		for _, file := range job.Files {
+			if file.Selected {
+				completed[job.ID] = append(completed[job.ID], file.Path)
+			}
+		}
+	}
 
-		mu.Lock()
-		defer mu.Unlock()
-		delete(progressMap, sessionID)
-		delete(downloadMap, sessionID)
-		delete(fileMap, sessionID)
-	}()
-
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(completed)
 }
 
-func cancelHandler(w http.ResponseWriter, r *http.Request) {
-	sessionID := r.URL.Query().Get("sessionID")
-	if sessionID == "" {
-		http.Error(w, "sessionID is required", http.StatusBadRequest)
+func downloadCompletedHandler(w http.ResponseWriter, r *http.Request, downloadDir string) {
+	fileName := r.URL.Path[len("/download/"):]
+	// Only the video files /files lists are served, never the state file,
+	// the saved .torrent files or anything else kept in the directory
+	if !isListedVideoFile(fileName) {
+		http.Error(w, "file not found", http.StatusNotFound)
 		return
 	}
+	filePath := filepath.Join(downloadDir, filepath.FromSlash(fileName))
 
-	mu.Lock()
-	defer mu.Unlock()
+	info, err := os.Lstat(filePath)
+	if err != nil || !info.Mode().IsRegular() {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", path.Base(fileName)))
+	http.ServeFile(w, r, filePath)
+}
 
-	cancelChan, exists := downloadMap[sessionID]
-	if !exists {
-		http.Error(w, "no download in progress for this session", http.StatusNotFound)
+func filesHandler(w http.ResponseWriter, r *http.Request, downloadDir string) {
+	videoFiles, err := listVideoFiles(downloadDir)
+	if err != nil {
+		http.Error(w, "failed to read directory", http.StatusInternalServerError)
 		return
 	}
 
-	// Signal the download goroutine to cancel
-	cancelChan <- true
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(videoFiles)
+}
+
+// listVideoFiles returns the paths, relative to the download directory, of
+// the .mkv and .mp4 files in it, skipping hidden files and directories such
+// as the engine's own.
+func listVideoFiles(downloadDir string) ([]string, error) {
+	videoFiles := []string{}
 
-	// Delete the file and reset the state
-	if filePath, exists := fileMap[sessionID]; exists {
-		if err := os.Remove(filePath); err != nil {
-			log.Printf("Error deleting file: %v", err)
+	err := filepath.Walk(downloadDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
 		}
-		delete(fileMap, sessionID)
-	}
+		if path != downloadDir && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() && isVideoFile(info.Name()) {
+			relPath, err := filepath.Rel(downloadDir, path)
+			if err != nil {
+				return err
+			}
+			videoFiles = append(videoFiles, filepath.ToSlash(relPath))
+		}
+		return nil
+	})
 
-	// Reset the progress state
-	progressMap[sessionID] = &ProgressResponse{
-		Progress:        0,
-		DownloadedBytes: 0,
-		TotalSizeBytes:  0,
-	}
+	return videoFiles, err
+}
 
-	w.WriteHeader(http.StatusOK)
+func isVideoFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".mkv" || ext == ".mp4"
 }
 
-func basicAuth(handler http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		user, pass, ok := r.BasicAuth()
-		if !ok || users[user] != pass {
-			w.Header().Set("WWW-Authenticate", `Basic realm="Please enter your username and password."`)
-			w.WriteHeader(http.StatusUnauthorized)
-			fmt.Fprintln(w, "Unauthorized")
-			return
+// isListedVideoFile reports whether the slash-separated path, relative to the
+// download directory, is one listVideoFiles could return.
+func isListedVideoFile(name string) bool {
+	if !filepath.IsLocal(filepath.FromSlash(name)) || !isVideoFile(name) {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return false
 		}
-		handler(w, r)
 	}
+	return true
+}
+
+// reloadSettings re-reads the users and limits from the config file, the
+// users file and the environment, leaving running downloads alone. Nothing
+// changes if any of them is invalid, or if auth is on and no users are left.
+func reloadSettings(configPath string, explicit map[string]bool, config *engine.Config, auth bool) error {
+	var s *settings
+	var configUsers map[string]string
+	if configPath != "" {
+		var err error
+		if s, err = loadSettings(configPath); err != nil {
+			return err
+		}
+		configUsers = s.users
+	}
+	loaded, err := loadUsers(configUsers, usersFile, withDemo)
+	if err != nil {
+		return err
+	}
+	if auth && len(loaded) == 0 {
+		return errors.New("no users configured")
+	}
+	dummyHash, err := dummyHashFor(loaded)
+	if err != nil {
+		return err
+	}
+	if err := applySettings(reloadableSettings, s, explicit); err != nil {
+		return err
+	}
+
+	manager.SetDefaultLimits(config.Limits)
+	manager.SetMaxActive(config.MaxActive)
+	usersMu.Lock()
+	users = loaded
+	unknownUserHash = dummyHash
+	usersMu.Unlock()
+	return nil
 }
 
 func main() {
-	var downloadDir string
+	if len(os.Args) > 1 && os.Args[1] == "user" {
+		if err := userCommand(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
+	}
+
+	var config engine.Config
+	var configPath string
+	var listen string
 	var port int
+	var schedulePath string
+	var noAuth bool
+	var loginAttempts int
+	var loginLockout time.Duration
 
-	flag.StringVar(&downloadDir, "dir", ".", "Download directory")
+	flag.StringVar(&configPath, "config", "", "YAML, TOML or JSON config file; flags and RSD2_* environment variables override it")
+	flag.StringVar(&config.DownloadDir, "dir", ".", "Download directory")
+	flag.StringVar(&config.StatePath, "state", "", "Job state file (default .rsd2-state.json in the download directory)")
+	flag.StringVar(&listen, "listen", "", "Address to listen on, such as 127.0.0.1:8080 (default all interfaces on -port)")
 	flag.IntVar(&port, "port", 8080, "Server port")
+	flag.BoolVar(&noAuth, "no-auth", false, "Serve every page, API call and file without authentication, for example behind a proxy that already handles it")
+	flag.StringVar(&usersFile, "users-file", "", "htpasswd-style file of users with bcrypt or argon2id hashes, managed with \"rsd2 user add\"")
+	flag.IntVar(&loginAttempts, "login-attempts", 5, "Failed logins from one address before it is locked out (0 for no limit)")
+	flag.DurationVar(&loginLockout, "login-lockout", 15*time.Minute, "How long an address is locked out after too many failed logins")
+	flag.BoolVar(&withDemo, "insecure-demo-users", false, "Also accept the well-known demo users demo/password and downloads/downloads")
+	flag.BoolVar(&fileBrowser, "file-browser", false, "List downloaded video files on the page and serve them under /download/")
+	flag.BoolVar(&config.AllowPrivateURLs, "allow-private-urls", false, "Let .torrent links point at loopback, link-local and private network addresses, such as a tracker on the LAN")
+	flag.DurationVar(&config.MetadataTimeout, "metadata-timeout", 10*time.Minute, "How long to wait for a magnet's metadata before failing (0 waits forever)")
+	flag.DurationVar(&config.StallTimeout, "stall-timeout", 10*time.Minute, "How long a download may receive no data before it is marked stalled (0 disables)")
+	flag.IntVar(&config.Retries, "retries", 0, "How many times to re-add a download that timed out or stalled")
+	flag.IntVar(&config.MaxActive, "max-active", 3, "How many downloads may run at once; the rest wait in a queue (0 for no limit)")
+	flag.Int64Var(&config.Limits.DownloadRateLimit, "max-download-rate", 0, "Global download rate limit in bytes per second (0 for no limit)")
+	flag.Int64Var(&config.Limits.UploadRateLimit, "max-upload-rate", 0, "Global upload rate limit in bytes per second (0 for no limit)")
+	flag.StringVar(&schedulePath, "schedule", "", "JSON file of bandwidth profiles to apply by time of day")
+	flag.Float64Var(&config.SeedRatio, "seed-ratio", 0, "Upload ratio at which a finished download stops seeding (0 for no limit)")
+	flag.DurationVar(&config.SeedTime, "seed-time", 0, "How long a finished download seeds before it stops (0 for no limit)")
+	flag.StringVar(&config.SeedAction, "seed-action", engine.SeedActionStop, "What to do once seeding ends: stop the torrent, or remove it and its job from the list")
 	flag.Parse()
 
-	http.HandleFunc("/", basicAuth(indexHandler))
-	http.HandleFunc("/progress", basicAuth(progressHandler))
-	http.HandleFunc("/download", basicAuth(func(w http.ResponseWriter, r *http.Request) {
-		downloadHandler(w, r, downloadDir)
-	}))
-	http.HandleFunc("/cancel", basicAuth(cancelHandler))
+	// Flags given on the command line win over the environment and the file
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	if configPath == "" {
+		configPath = os.Getenv(envName("config"))
+	}
+
+	var fileSettings *settings
+	var err error
+	if configPath != "" {
+		fileSettings, err = loadSettings(configPath)
+		if err != nil {
+			log.Fatalf("Error loading config: %v", err)
+		}
+	}
+	var names []string
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name != "config" {
+			names = append(names, f.Name)
+		}
+	})
+	if err := applySettings(names, fileSettings, explicit); err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+
+	var configUsers map[string]string
+	if fileSettings != nil {
+		configUsers = fileSettings.users
+	}
+	users, err = loadUsers(configUsers, usersFile, withDemo)
+	if err != nil {
+		log.Fatalf("Error loading users: %v", err)
+	}
+	if !noAuth && len(users) == 0 {
+		log.Fatal("No users configured: add one with \"rsd2 user add -file <path> <name>\" and start with -users-file <path>, or start with -no-auth")
+	}
+	if withDemo {
+		log.Println("Warning: the insecure demo users are enabled")
+	}
+	unknownUserHash, err = dummyHashFor(users)
+	if err != nil {
+		log.Fatalf("Error loading users: %v", err)
+	}
+	loginLimiter = newLoginThrottle(loginAttempts, loginLockout)
+
+	if schedulePath != "" {
+		config.Schedule, err = engine.LoadSchedule(schedulePath)
+		if err != nil {
+			log.Fatalf("Error loading schedule: %v", err)
+		}
+	}
+
+	manager, err = engine.New(config)
+	if err != nil {
+		log.Fatalf("Error starting download engine: %v", err)
+	}
+	defer manager.Close()
 
-	log.Printf("Server started at http://localhost:%d", port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+	// SIGHUP reloads the users and limits
+	go func() {
+		hangups := make(chan os.Signal, 1)
+		signal.Notify(hangups, syscall.SIGHUP)
+		for range hangups {
+			if err := reloadSettings(configPath, explicit, &config, !noAuth); err != nil {
+				log.Printf("Error reloading config: %v", err)
+				continue
+			}
+			log.Println("Config reloaded")
+		}
+	}()
+
+	if listen == "" {
+		listen = fmt.Sprintf(":%d", port)
+	}
+
+	// Every route goes through the same middleware, so file serving is no
+	// less protected than the API
+	middleware := basicAuth
+	if noAuth {
+		log.Printf("Warning: authentication is disabled, so anyone who can reach %s can start downloads and read the files", listen)
+		middleware = func(handler http.HandlerFunc) http.HandlerFunc {
+			return handler
+		}
+	}
+	// A mux of our own, so nothing registered on the default one is served
+	// around the middleware
+	mux := http.NewServeMux()
+	handle := func(pattern string, handler http.HandlerFunc) {
+		mux.HandleFunc(pattern, middleware(handler))
+	}
+
+	downloadDir := config.DownloadDir
+	handle("/", indexHandler)
+	handle("/jobs", jobsHandler)
+	handle("/jobs/", jobHandler)
+	handle("/events", func(w http.ResponseWriter, r *http.Request) {
+		eventsHandler(w, r, downloadDir)
+	})
+	handle("/limits", limitsHandler)
+	handle("/bandwidth", bandwidthHandler)
+	handle("/download", downloadHandler)
+	if fileBrowser {
+		handle("/completed", completedHandler)
+		handle("/download/", func(w http.ResponseWriter, r *http.Request) {
+			downloadCompletedHandler(w, r, downloadDir)
+		})
+		handle("/files", func(w http.ResponseWriter, r *http.Request) {
+			filesHandler(w, r, downloadDir)
+		})
+	}
+
+	// SIGINT and SIGTERM stop the server and then the engine, which saves
+	// the running downloads to resume on the next start
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	server := &http.Server{
+		Addr:    listen,
+		Handler: mux,
+		// Ends the /events streams on shutdown rather than waiting them out
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+	log.Printf("Server started on %s", listen)
+
+	select {
+	case err := <-serveErr:
+		manager.Close()
+		log.Fatalf("Server error: %v", err)
+	case <-ctx.Done():
+	}
+	// A second signal kills the process straight away
+	stop()
+
+	log.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down server: %v", err)
+	}
 }
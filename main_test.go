@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestIsListedVideoFile(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"movie.mkv", true},
+		{"movie.MP4", true},
+		{"show/season 1/episode.mkv", true},
+		{"movie.avi", false},
+		{"movie.mkv.part", false},
+		{"", false},
+		{".hidden.mkv", false},
+		{"show/.hidden/episode.mkv", false},
+		{".rsd2-torrents/movie.mkv", false},
+		{"../movie.mkv", false},
+		{"show/../../movie.mkv", false},
+		{"/etc/movie.mkv", false},
+		{"show/./episode.mkv", false},
+	}
+
+	for _, tt := range tests {
+		if got := isListedVideoFile(tt.name); got != tt.want {
+			t.Errorf("isListedVideoFile(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
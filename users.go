@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+
+	"github.com/omgbox/rsd2/engine"
+	"golang.org/x/term"
+)
+
+// demoUsers are the well-known accounts enabled by -insecure-demo-users, for
+// trying the app out only.
+var demoUsers = map[string]string{
+	"demo":      "password",
+	"downloads": "downloads",
+}
+
+const userUsage = `usage: rsd2 user add [-file path] [-hash bcrypt|argon2id] <name>
+       rsd2 user remove [-file path] <name>
+
+add asks for the password, or reads it from standard input when that is not
+a terminal, and stores its hash, bcrypt unless -hash says otherwise. The file
+defaults to $RSD2_USERS_FILE.`
+
+// loadUsers gathers the credentials as password hashes by user name: the
+// demo users if asked for, then the config file's users, then the users file,
+// each replacing a user of the same name from the one before. Config file
+// passwords that are not already bcrypt or argon2id hashes are hashed here.
+func loadUsers(configUsers map[string]string, usersFile string, demo bool) (map[string]string, error) {
+	given := make(map[string]string)
+	if demo {
+		maps.Copy(given, demoUsers)
+	}
+	maps.Copy(given, configUsers)
+
+	loaded := make(map[string]string)
+	for user, password := range given {
+		if checkHash(password) == nil {
+			loaded[user] = password
+			continue
+		}
+		hash, err := hashPassword(password, hashBcrypt)
+		if err != nil {
+			return nil, fmt.Errorf("user %q: %w", user, err)
+		}
+		loaded[user] = hash
+	}
+
+	if usersFile != "" {
+		entries, err := readUsersFile(usersFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			loaded[entry.name] = entry.hash
+		}
+	}
+
+	return loaded, nil
+}
+
+// userEntry is one "name:hash" line of a users file.
+type userEntry struct {
+	name string
+	hash string
+}
+
+// readUsersFile reads an htpasswd-style file of "name:hash" lines, with
+// bcrypt or argon2id hashes as written by "rsd2 user add" or "htpasswd -B".
+// Blank lines and lines starting with # are skipped.
+func readUsersFile(path string) ([]userEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read users file: %w", err)
+	}
+
+	var entries []userEntry
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, hash, found := strings.Cut(line, ":")
+		if !found || name == "" {
+			return nil, fmt.Errorf("users file line %d: expected name:hash", i+1)
+		}
+		if err := checkHash(hash); err != nil {
+			return nil, fmt.Errorf("users file line %d: user %q: %w", i+1, name, err)
+		}
+		entries = append(entries, userEntry{name: name, hash: hash})
+	}
+	return entries, nil
+}
+
+// writeUsersFile replaces the users file.
+func writeUsersFile(path string, entries []userEntry) error {
+	var b strings.Builder
+	for _, entry := range entries {
+		fmt.Fprintf(&b, "%s:%s\n", entry.name, entry.hash)
+	}
+
+	if err := engine.WriteFileAtomic(path, []byte(b.String()), 0600); err != nil {
+		return fmt.Errorf("failed to write users file: %w", err)
+	}
+	return nil
+}
+
+// userCommand runs "rsd2 user add" or "rsd2 user remove" on a users file,
+// which is rewritten without its comments. A running server picks the change
+// up on SIGHUP.
+func userCommand(args []string) error {
+	if len(args) == 0 || args[0] != "add" && args[0] != "remove" {
+		return errors.New(userUsage)
+	}
+
+	fs := flag.NewFlagSet("user "+args[0], flag.ContinueOnError)
+	path := fs.String("file", os.Getenv(envName("users-file")), "Users file to change")
+	scheme := fs.String("hash", hashBcrypt, "Password hash to store: bcrypt or argon2id")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *path == "" || fs.NArg() != 1 {
+		return errors.New(userUsage)
+	}
+	name := fs.Arg(0)
+	if name == "" || strings.ContainsAny(name, ": \t\r\n#") {
+		return fmt.Errorf("invalid user name %q", name)
+	}
+
+	entries, err := readUsersFile(*path)
+	if errors.Is(err, os.ErrNotExist) && args[0] == "add" {
+		entries, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	index := -1
+	for i, entry := range entries {
+		if entry.name == name {
+			index = i
+		}
+	}
+
+	if args[0] == "remove" {
+		if index < 0 {
+			return fmt.Errorf("no user %q in %s", name, *path)
+		}
+		entries = append(entries[:index], entries[index+1:]...)
+		return writeUsersFile(*path, entries)
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+	hash, err := hashPassword(password, *scheme)
+	if err != nil {
+		return err
+	}
+
+	if index >= 0 {
+		entries[index].hash = hash
+	} else {
+		entries = append(entries, userEntry{name: name, hash: hash})
+	}
+	return writeUsersFile(*path, entries)
+}
+
+// readPassword prompts for a password twice on a terminal, or reads the first
+// line of standard input otherwise.
+func readPassword() (string, error) {
+	var password string
+	stdin := int(os.Stdin.Fd())
+	if term.IsTerminal(stdin) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		first, err := term.ReadPassword(stdin)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("failed to read password: %w", err)
+		}
+		fmt.Fprint(os.Stderr, "Repeat password: ")
+		second, err := term.ReadPassword(stdin)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("failed to read password: %w", err)
+		}
+		if string(first) != string(second) {
+			return "", errors.New("passwords do not match")
+		}
+		password = string(first)
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("failed to read password: %w", err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	if password == "" {
+		return "", errors.New("password must not be empty")
+	}
+	return password, nil
+}